@@ -0,0 +1,119 @@
+package lazyseq
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+// An Accumulator is a Grad which accumulates gradients
+// over multiple back-propagation steps, such as the
+// micro-batches of a larger batch.
+//
+// An Accumulator can be passed directly to a Seq's
+// Propagate method, in which case gradients are added to
+// it with a scale of 1.
+// For a scaled contribution, use PropagateSeq or
+// PropagateRes.
+type Accumulator struct {
+	lock  sync.Mutex
+	grad  anydiff.Grad
+	steps int
+}
+
+// NewAccumulator creates an Accumulator which adds to the
+// raw gradient g.
+func NewAccumulator(g anydiff.Grad) *Accumulator {
+	return &Accumulator{grad: g}
+}
+
+// Use calls f with the accumulated gradient, blocking all
+// other calls to Use while f is running.
+func (a *Accumulator) Use(f func(g anydiff.Grad)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	f(a.grad)
+}
+
+// PropagateSeq back-propagates through seq, scaling the
+// resulting gradient by scale.
+//
+// Since gradients are linear in the upstream batches,
+// the upstream batches are scaled instead of the
+// gradient.
+// This way, seq accumulates directly into a without any
+// scratch space.
+// Like Seq.Propagate, this may modify the upstream
+// vectors.
+//
+// Each call to PropagateSeq counts as an accumulation
+// step.
+func (a *Accumulator) PropagateSeq(seq Seq, upstream <-chan *anyseq.Batch,
+	scale float64) {
+	a.lock.Lock()
+	a.steps++
+	a.lock.Unlock()
+
+	scaled := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range upstream {
+			batch.Packed.Scale(batch.Packed.Creator().MakeNumeric(scale))
+			scaled <- batch
+		}
+		close(scaled)
+	}()
+	seq.Propagate(scaled, a)
+}
+
+// PropagateRes back-propagates through r with the
+// upstream vector u, scaling the resulting gradient by
+// scale.
+//
+// This is intended for the results of functions like
+// Mean, Tail, and PoolToVec, whose Propagate methods take
+// a raw gradient.
+// The upstream vector u is not modified.
+//
+// Each call to PropagateRes counts as an accumulation
+// step.
+func (a *Accumulator) PropagateRes(r anydiff.Res, u anyvec.Vector, scale float64) {
+	scaledU := u.Copy()
+	scaledU.Scale(u.Creator().MakeNumeric(scale))
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.steps++
+	r.Propagate(scaledU, a.grad)
+}
+
+// Steps returns the number of accumulation steps since
+// the accumulator was created or last zeroed.
+func (a *Accumulator) Steps() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.steps
+}
+
+// Zero resets the accumulated gradient to zero and resets
+// the step count.
+func (a *Accumulator) Zero() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.steps = 0
+	for _, vec := range a.grad {
+		vec.Set(vec.Creator().MakeVector(vec.Len()))
+	}
+}
+
+// Snapshot copies the accumulated gradient.
+func (a *Accumulator) Snapshot() anydiff.Grad {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	res := anydiff.Grad{}
+	for v, vec := range a.grad {
+		res[v] = vec.Copy()
+	}
+	return res
+}
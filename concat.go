@@ -0,0 +1,157 @@
+package lazyseq
+
+import (
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+)
+
+type concatTimeRes struct {
+	Ins []Seq
+	Out <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done <-chan struct{}
+	Lens []int
+	V    anydiff.VarSet
+}
+
+// ConcatTime joins sequences along the time axis, so that
+// the timesteps of each Seq come after the timesteps of
+// the previous one.
+//
+// All of the Seqs must have the same number of lanes.
+// A lane which is absent at the end of one Seq must not
+// be present at the start of the next.
+//
+// It is invalid to concatenate 0 sequences.
+func ConcatTime(seqs ...Seq) Seq {
+	if len(seqs) == 0 {
+		panic("need at least one sequence")
+	}
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &concatTimeRes{
+		Ins:  seqs,
+		Out:  outChan,
+		Done: doneChan,
+		Lens: make([]int, len(seqs)),
+		V:    anydiff.VarSet{},
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (c *concatTimeRes) Creator() anyvec.Creator {
+	return c.Ins[0].Creator()
+}
+
+func (c *concatTimeRes) Forward() <-chan *anyseq.Batch {
+	return c.Out
+}
+
+func (c *concatTimeRes) Vars() anydiff.VarSet {
+	<-c.Done
+	return c.V
+}
+
+func (c *concatTimeRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range c.Forward() {
+	}
+
+	downstreams, wg := propagateMany(c.Ins, grad)
+	for i := len(c.Ins) - 1; i >= 0; i-- {
+		for j := 0; j < c.Lens[i]; j++ {
+			u, ok := <-upstream
+			if !ok {
+				panic("not enough upstream batches")
+			}
+			if downstreams[i] != nil {
+				downstreams[i] <- u
+			}
+		}
+		if downstreams[i] != nil {
+			close(downstreams[i])
+		}
+	}
+
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	wg.Wait()
+}
+
+func (c *concatTimeRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	var lastPresent []bool
+	for i, in := range c.Ins {
+		for batch := range in.Forward() {
+			if lastPresent != nil {
+				if len(lastPresent) != len(batch.Present) {
+					panic("mismatching present map size")
+				}
+				for j, newPres := range batch.Present {
+					if newPres && !lastPresent[j] {
+						panic("absent sequence became present again")
+					}
+				}
+			}
+			lastPresent = batch.Present
+			c.Lens[i]++
+			out <- batch
+		}
+	}
+	for _, in := range c.Ins {
+		c.V = anydiff.MergeVarSets(c.V, in.Vars())
+	}
+	close(done)
+	close(out)
+}
+
+type concatTimeRereader struct {
+	*concatTimeRes
+	Rereaders []Rereader
+}
+
+// ConcatTimeRereader is like ConcatTime, but for
+// Rereaders.
+func ConcatTimeRereader(rs ...Rereader) Rereader {
+	plain := make([]Seq, len(rs))
+	for i, x := range rs {
+		plain[i] = x
+	}
+	return &concatTimeRereader{
+		concatTimeRes: ConcatTime(plain...).(*concatTimeRes),
+		Rereaders:     rs,
+	}
+}
+
+func (c *concatTimeRereader) Reread(start, end int) <-chan *anyseq.Batch {
+	<-c.Done
+
+	var totalLen int
+	for _, l := range c.Lens {
+		totalLen += l
+	}
+	if start < 0 || end < start || end > totalLen {
+		panic("slice bounds out of range")
+	}
+
+	out := make(chan *anyseq.Batch, 1)
+	go func() {
+		defer close(out)
+		var offset int
+		for i, r := range c.Rereaders {
+			subStart := essentials.MaxInt(start, offset) - offset
+			subEnd := essentials.MinInt(end, offset+c.Lens[i]) - offset
+			if subStart < subEnd {
+				for batch := range r.Reread(subStart, subEnd) {
+					out <- batch
+				}
+			}
+			offset += c.Lens[i]
+		}
+	}()
+	return out
+}
@@ -0,0 +1,235 @@
+package lazyseq
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+)
+
+type conv1DRes struct {
+	In       Rereader
+	Kernel   anydiff.Res
+	Width    int
+	Dilation int
+	Out      <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done       <-chan struct{}
+	Presents   [][]bool
+	PackedLens []int
+	V          anydiff.VarSet
+}
+
+// Conv1D applies a causal convolution over time to r.
+//
+// The kernel consists of width matrices, stored one after
+// another in row-major order.
+// Each matrix has one column per input component.
+// The output at timestep t is the sum, over j in
+// [0, width), of the j-th matrix times the input at
+// timestep t-j*dilation.
+// Inputs before the start of a sequence are treated as
+// zero vectors.
+//
+// The result only stores the last (width-1)*dilation+1
+// inputs at any given time.
+// During back-propagation, the inputs are reread one at
+// a time, so each timestep of r is reread width times.
+func Conv1D(r Rereader, kernel anydiff.Res, width, dilation int) Rereader {
+	if width < 1 || dilation < 1 {
+		panic("invalid width or dilation")
+	}
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &conv1DRes{
+		In:       r,
+		Kernel:   kernel,
+		Width:    width,
+		Dilation: dilation,
+		Out:      outChan,
+		Done:     doneChan,
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (c *conv1DRes) Creator() anyvec.Creator {
+	return c.In.Creator()
+}
+
+func (c *conv1DRes) Forward() <-chan *anyseq.Batch {
+	return c.Out
+}
+
+func (c *conv1DRes) Vars() anydiff.VarSet {
+	<-c.Done
+	return c.V
+}
+
+func (c *conv1DRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range c.Forward() {
+	}
+
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		c.In.Propagate(downstream, grad)
+		wg.Done()
+	}()
+
+	// Input gradients which are still receiving
+	// contributions from later outputs.
+	pending := map[int]anyvec.Vector{}
+
+	for t := len(c.Presents) - 1; t >= 0; t-- {
+		u, ok := <-upstream
+		if !ok {
+			panic("not enough upstream batches")
+		}
+		present := c.Presents[t]
+		taps := make([]anydiff.Res, c.Width)
+		pools := make([]*anydiff.Var, c.Width)
+		for j := range taps {
+			src := t - j*c.Dilation
+			if src < 0 {
+				break
+			}
+			var batch *anyseq.Batch
+			for b := range c.In.Reread(src, src+1) {
+				batch = b
+			}
+			pools[j] = anydiff.NewVar(batch.Reduce(present).Packed)
+			taps[j] = pools[j]
+		}
+
+		grad.Use(func(g anydiff.Grad) {
+			for _, pool := range pools {
+				if pool != nil {
+					g[pool] = pool.Vector.Creator().MakeVector(pool.Vector.Len())
+				}
+			}
+			out := c.applyKernel(u.NumPresent(), taps)
+			out.Propagate(u.Packed, g)
+			for j, pool := range pools {
+				if pool == nil {
+					continue
+				}
+				src := t - j*c.Dilation
+				if pending[src] == nil {
+					pending[src] = c.Creator().MakeVector(c.PackedLens[src])
+				}
+				reduced := &anyseq.Batch{Present: present, Packed: g[pool]}
+				pending[src].Add(reduced.Expand(c.Presents[src]).Packed)
+				delete(g, pool)
+			}
+		})
+
+		downstream <- &anyseq.Batch{Present: present, Packed: pending[t]}
+		delete(pending, t)
+	}
+
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+func (c *conv1DRes) Reread(start, end int) <-chan *anyseq.Batch {
+	<-c.Done
+	if start < 0 || end < start || end > len(c.Presents) {
+		panic("slice bounds out of range")
+	}
+	srcStart := essentials.MaxInt(0, start-(c.Width-1)*c.Dilation)
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		c.convolve(c.In.Reread(srcStart, end), srcStart, start, res)
+		close(res)
+	}()
+	return res
+}
+
+func (c *conv1DRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	in := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range c.In.Forward() {
+			c.Presents = append(c.Presents, batch.Present)
+			c.PackedLens = append(c.PackedLens, batch.Packed.Len())
+			in <- batch
+		}
+		close(in)
+	}()
+	c.convolve(in, 0, 0, out)
+	c.V = anydiff.MergeVarSets(c.In.Vars(), c.Kernel.Vars())
+	close(done)
+	close(out)
+}
+
+// convolve produces the outputs for every timestep from
+// start onward, given a channel of input timesteps which
+// begins at timestep srcStart.
+func (c *conv1DRes) convolve(in <-chan *anyseq.Batch, srcStart, start int,
+	out chan<- *anyseq.Batch) {
+	history := make([]*anyseq.Batch, (c.Width-1)*c.Dilation+1)
+	t := srcStart
+	for batch := range in {
+		copy(history[1:], history)
+		history[0] = batch
+		if t >= start {
+			taps := make([]anydiff.Res, c.Width)
+			for j := range taps {
+				tap := history[j*c.Dilation]
+				if tap == nil {
+					break
+				}
+				taps[j] = anydiff.NewConst(tap.Reduce(batch.Present).Packed)
+			}
+			out <- &anyseq.Batch{
+				Present: batch.Present,
+				Packed:  c.applyKernel(batch.NumPresent(), taps).Output(),
+			}
+		}
+		t++
+	}
+}
+
+// applyKernel computes the output for a timestep given
+// the input for each tap of the kernel.
+// Taps before the start of the sequences are nil.
+func (c *conv1DRes) applyKernel(n int, taps []anydiff.Res) anydiff.Res {
+	inSize := taps[0].Output().Len() / n
+	kernelSize := c.Kernel.Output().Len()
+	if kernelSize%(c.Width*inSize) != 0 {
+		panic(fmt.Sprintf("kernel size %d not divisible by width*inSize = %d",
+			kernelSize, c.Width*inSize))
+	}
+	outSize := kernelSize / (c.Width * inSize)
+	matSize := outSize * inSize
+
+	var sum anydiff.Res
+	for j, tap := range taps {
+		if tap == nil {
+			break
+		}
+		product := anydiff.MatMul(false, true,
+			&anydiff.Matrix{Data: tap, Rows: n, Cols: inSize},
+			&anydiff.Matrix{
+				Data: anydiff.Slice(c.Kernel, j*matSize, (j+1)*matSize),
+				Rows: outSize,
+				Cols: inSize,
+			},
+		).Data
+		if sum == nil {
+			sum = product
+		} else {
+			sum = anydiff.Add(sum, product)
+		}
+	}
+	return sum
+}
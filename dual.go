@@ -0,0 +1,329 @@
+package lazyseq
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+// Tangents maps variables to tangent vectors.
+// A tangent vector is the direction in which a variable
+// is moved when computing a directional derivative.
+//
+// Variables which are not in the map have zero tangents.
+type Tangents map[*anydiff.Var]anyvec.Vector
+
+// Vars returns the variables in v which have tangents.
+func (t Tangents) Vars(v anydiff.VarSet) []*anydiff.Var {
+	var res []*anydiff.Var
+	for _, x := range v.Slice() {
+		if _, ok := t[x]; ok {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// A DualBatch is a batch of outputs paired with the
+// directional derivative of those outputs.
+type DualBatch struct {
+	// Packed is the output, just like in anyseq.Batch.
+	Packed anyvec.Vector
+
+	// Tangent is the directional derivative of Packed.
+	// It is the same length as Packed.
+	Tangent anyvec.Vector
+
+	Present []bool
+}
+
+// NumPresent returns the number of present sequences.
+func (d *DualBatch) NumPresent() int {
+	return d.Batch().NumPresent()
+}
+
+// Batch returns the output part of the batch.
+func (d *DualBatch) Batch() *anyseq.Batch {
+	return &anyseq.Batch{Packed: d.Packed, Present: d.Present}
+}
+
+// TangentBatch returns the tangent part of the batch.
+func (d *DualBatch) TangentBatch() *anyseq.Batch {
+	return &anyseq.Batch{Packed: d.Tangent, Present: d.Present}
+}
+
+// A DualSeq is a lazily-evaluated sequence which produces
+// directional derivatives (Jacobian-vector products)
+// alongside its outputs.
+//
+// Tangents are computed in forward-mode, one timestep at
+// a time, so nothing has to be stored for later.
+// Unlike a Seq, a DualSeq cannot be back-propagated
+// through.
+type DualSeq interface {
+	// Creator returns the anyvec.Creator associated with
+	// the sequence.
+	Creator() anyvec.Creator
+
+	// Forward returns a channel of sequence outputs,
+	// starting with the first output.
+	// The channel is closed once all outputs have been
+	// sent.
+	//
+	// The same channel is returned every time.
+	Forward() <-chan *DualBatch
+}
+
+type dualChan struct {
+	C   anyvec.Creator
+	Out <-chan *DualBatch
+}
+
+// DualChan creates a DualSeq which produces the batches
+// sent to ch.
+// The caller should close ch after the last batch.
+func DualChan(c anyvec.Creator, ch <-chan *DualBatch) DualSeq {
+	return &dualChan{C: c, Out: ch}
+}
+
+func (d *dualChan) Creator() anyvec.Creator {
+	return d.C
+}
+
+func (d *dualChan) Forward() <-chan *DualBatch {
+	return d.Out
+}
+
+// LazifyDual creates a DualSeq from an anyseq.Seq and the
+// tangent of that sequence.
+//
+// If tangent is nil, the tangents are all zero.
+// Otherwise, tangent must have the same shape as seq.
+//
+// The tangents of any variables upon which seq depends
+// are not taken into account.
+// To differentiate with respect to variables, pass them
+// to MapNDual or to lazyrnn.ApplyDual.
+func LazifyDual(seq, tangent anyseq.Seq) DualSeq {
+	c := seq.Creator()
+	outs := seq.Output()
+	var tangents []*anyseq.Batch
+	if tangent != nil {
+		tangents = tangent.Output()
+		if len(tangents) != len(outs) {
+			panic("tangent length mismatch")
+		}
+	}
+
+	outChan := make(chan *DualBatch, 1)
+	go func() {
+		for i, batch := range outs {
+			var t anyvec.Vector
+			if tangents != nil {
+				if !presentMapsEqual(tangents[i].Present, batch.Present) ||
+					tangents[i].Packed.Len() != batch.Packed.Len() {
+					panic("tangent shape mismatch")
+				}
+				t = tangents[i].Packed
+			} else {
+				t = c.MakeVector(batch.Packed.Len())
+			}
+			outChan <- &DualBatch{
+				Packed:  batch.Packed,
+				Tangent: t,
+				Present: batch.Present,
+			}
+		}
+		close(outChan)
+	}()
+	return DualChan(c, outChan)
+}
+
+// MapNDual is like MapN, but for DualSeqs.
+//
+// The tangents of the outputs account for both the input
+// tangents and the tangents of any variables which f
+// uses.
+//
+// Since anydiff only supports reverse-mode, the tangent
+// at each timestep is computed by back-propagating
+// through f once per output component.
+// Each pass is exact, and nothing is stored across
+// timesteps, but f should produce small outputs.
+func MapNDual(f func(n int, v ...anydiff.Res) anydiff.Res, t Tangents,
+	s ...DualSeq) DualSeq {
+	if len(s) == 0 {
+		panic("need at least one input")
+	}
+	c := s[0].Creator()
+
+	// The inputs are offset by eps times their tangents,
+	// so that the derivative with respect to eps is the
+	// Jacobian-vector product for the inputs.
+	eps := anydiff.NewVar(c.MakeVector(1))
+
+	outChan := make(chan *DualBatch, 1)
+	go func() {
+		for {
+			batches := make([]*DualBatch, len(s))
+			var numOpen int
+			for i, seq := range s {
+				if batch, ok := <-seq.Forward(); ok {
+					batches[i] = batch
+					numOpen++
+				}
+			}
+			if numOpen == 0 {
+				break
+			} else if numOpen != len(s) {
+				panic("mismatching sequence lengths")
+			}
+			var ins []anydiff.Res
+			for _, batch := range batches {
+				if !presentMapsEqual(batch.Present, batches[0].Present) {
+					panic("mismatching present maps")
+				}
+				ins = append(ins, anydiff.Add(anydiff.NewConst(batch.Packed),
+					anydiff.ScaleRepeated(anydiff.NewConst(batch.Tangent), eps)))
+			}
+			out := f(batches[0].NumPresent(), ins...)
+			outChan <- &DualBatch{
+				Packed:  out.Output(),
+				Tangent: mapTangent(out, eps, t),
+				Present: batches[0].Present,
+			}
+		}
+		close(outChan)
+	}()
+	return DualChan(c, outChan)
+}
+
+// mapTangent computes the tangent of a Res by
+// back-propagating a one-hot upstream vector for every
+// output component.
+func mapTangent(out anydiff.Res, eps *anydiff.Var, t Tangents) anyvec.Vector {
+	c := out.Output().Creator()
+	vars := append(t.Vars(out.Vars()), eps)
+	res := c.MakeVector(out.Output().Len())
+	for i := 0; i < res.Len(); i++ {
+		upstream := c.MakeVector(res.Len())
+		upstream.Slice(i, i+1).AddScalar(c.MakeNumeric(1))
+		g := anydiff.NewGrad(vars...)
+		out.Propagate(upstream, g)
+		component := res.Slice(i, i+1)
+		component.Add(g[eps])
+		for _, v := range vars[:len(vars)-1] {
+			component.AddScalar(g[v].Dot(t[v]))
+		}
+	}
+	return res
+}
+
+// PackDual is like PackSeq, but for DualSeqs.
+func PackDual(c anyvec.Creator, seqs []DualSeq) DualSeq {
+	outChan := make(chan *DualBatch, 1)
+	go func() {
+		lanesPerSeq := make([]int, len(seqs))
+		for {
+			var numOpen int
+			var values, tangents []*anyseq.Batch
+			for i, seq := range seqs {
+				if batch, ok := <-seq.Forward(); ok {
+					numOpen++
+					lanesPerSeq[i] = len(batch.Present)
+					values = append(values, batch.Batch())
+					tangents = append(tangents, batch.TangentBatch())
+				} else {
+					filler := fillerBatch(c, lanesPerSeq[i])
+					values = append(values, filler)
+					tangents = append(tangents, filler)
+				}
+			}
+			if numOpen == 0 {
+				break
+			}
+			value := joinBatches(c, values)
+			outChan <- &DualBatch{
+				Packed:  value.Packed,
+				Tangent: joinBatches(c, tangents).Packed,
+				Present: value.Present,
+			}
+		}
+		close(outChan)
+	}()
+	return DualChan(c, outChan)
+}
+
+// TailDual is like Tail, but for DualSeqs.
+// It returns the output and its tangent.
+func TailDual(seq DualSeq) (out, tangent anyvec.Vector) {
+	return reduceDual(seq, Tail)
+}
+
+// MeanDual is like Mean, but for DualSeqs.
+// It returns the output and its tangent.
+func MeanDual(seq DualSeq) (out, tangent anyvec.Vector) {
+	return reduceDual(seq, Mean)
+}
+
+// reduceDual applies a linear reduction to the outputs
+// and tangents of a DualSeq.
+// Since the reduction is linear, its tangent is the
+// reduction of the input tangents.
+func reduceDual(seq DualSeq, f func(s Seq) anydiff.Res) (out,
+	tangent anyvec.Vector) {
+	values, tangents := splitDual(seq)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tangent = f(tangents).Output()
+	}()
+	out = f(values).Output()
+	wg.Wait()
+	return
+}
+
+// splitDual splits a DualSeq into two constant Seqs, one
+// for the outputs and one for the tangents.
+// The two Seqs must be read concurrently.
+func splitDual(seq DualSeq) (values, tangents Seq) {
+	valChan := make(chan *anyseq.Batch, 1)
+	tanChan := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range seq.Forward() {
+			valChan <- batch.Batch()
+			tanChan <- batch.TangentBatch()
+		}
+		close(valChan)
+		close(tanChan)
+	}()
+	return &dualPart{C: seq.Creator(), Out: valChan},
+		&dualPart{C: seq.Creator(), Out: tanChan}
+}
+
+type dualPart struct {
+	C   anyvec.Creator
+	Out <-chan *anyseq.Batch
+}
+
+func (d *dualPart) Creator() anyvec.Creator {
+	return d.C
+}
+
+func (d *dualPart) Forward() <-chan *anyseq.Batch {
+	return d.Out
+}
+
+func (d *dualPart) Vars() anydiff.VarSet {
+	return anydiff.VarSet{}
+}
+
+func (d *dualPart) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range d.Forward() {
+	}
+	for _ = range upstream {
+	}
+}
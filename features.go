@@ -0,0 +1,84 @@
+package lazyseq
+
+import (
+	"fmt"
+
+	"github.com/unixpickle/anydiff"
+)
+
+// ConcatFeatures joins the vectors of several sequences
+// at every timestep.
+//
+// For each sequence in the batch, the resulting vector
+// is the concatenation of that sequence's vectors from
+// each of the Rereaders, in order.
+//
+// All of the Rereaders must be the same length and have
+// the same present maps.
+// At every timestep, each packed vector must be
+// divisible by the number of present sequences.
+//
+// It is invalid to concatenate 0 sequences.
+func ConcatFeatures(seqs ...Rereader) Rereader {
+	return MapN(func(n int, v ...anydiff.Res) anydiff.Res {
+		sizes := make([]int, len(v))
+		for i, x := range v {
+			if x.Output().Len()%n != 0 {
+				panic(fmt.Sprintf("ConcatFeatures: input %d has length %d, "+
+					"which is not divisible by batch size %d", i, x.Output().Len(), n))
+			}
+			sizes[i] = x.Output().Len() / n
+		}
+		var rows []anydiff.Res
+		for row := 0; row < n; row++ {
+			for i, x := range v {
+				rows = append(rows, anydiff.Slice(x, row*sizes[i], (row+1)*sizes[i]))
+			}
+		}
+		return anydiff.Concat(rows...)
+	}, seqs...)
+}
+
+// SplitFeatures is the inverse of ConcatFeatures.
+// It splits the vectors of seq into pieces of the given
+// sizes at every timestep.
+//
+// At every timestep, each sequence's vector must have
+// exactly as many components as the sum of the sizes.
+//
+// The results share seq in the same way as the results
+// of TeeRereader, including the buffering of upstream
+// gradients described for Tee.
+// Thus, either all or none of the results should be
+// propagated through.
+func SplitFeatures(seq Rereader, sizes ...int) []Rereader {
+	if len(sizes) == 0 {
+		panic("need at least one size")
+	}
+	var total int
+	for _, size := range sizes {
+		if size < 0 {
+			panic(fmt.Sprintf("SplitFeatures: invalid size %d", size))
+		}
+		total += size
+	}
+	res := make([]Rereader, len(sizes))
+	var offset int
+	for i, r := range TeeRereader(seq, len(sizes)) {
+		start, size := offset, sizes[i]
+		res[i] = Map(r, func(v anydiff.Res, n int) anydiff.Res {
+			if v.Output().Len() != n*total {
+				panic(fmt.Sprintf("SplitFeatures: vector length %d does not match "+
+					"batch size %d times total size %d", v.Output().Len(), n, total))
+			}
+			rows := make([]anydiff.Res, n)
+			for row := range rows {
+				rowStart := row*total + start
+				rows[row] = anydiff.Slice(v, rowStart, rowStart+size)
+			}
+			return anydiff.Concat(rows...)
+		})
+		offset += size
+	}
+	return res
+}
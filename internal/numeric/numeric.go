@@ -0,0 +1,28 @@
+// Package numeric converts anyvec data to Go floats.
+//
+// It is used where results have to be inspected on the
+// CPU, such as by finite-difference checks.
+package numeric
+
+import (
+	"fmt"
+
+	"github.com/unixpickle/anyvec"
+)
+
+// Floats converts a vector to a list of float64s.
+// The result is always a fresh copy.
+func Floats(v anyvec.Vector) []float64 {
+	switch data := v.Data().(type) {
+	case []float64:
+		return append([]float64{}, data...)
+	case []float32:
+		res := make([]float64, len(data))
+		for i, x := range data {
+			res[i] = float64(x)
+		}
+		return res
+	default:
+		panic(fmt.Sprintf("unsupported numeric list: %T", data))
+	}
+}
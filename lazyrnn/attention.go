@@ -0,0 +1,455 @@
+package lazyrnn
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/internal/numeric"
+)
+
+// An AttentionFunc computes attention logits for n pairs
+// of queries and keys.
+//
+// The query and keys arguments are packed, with one row
+// per pair.
+// The result should contain one logit per pair.
+type AttentionFunc func(query, keys anydiff.Res, n int) anydiff.Res
+
+// Decode applies a decoder block to a sequence while
+// attending over the outputs of an encoder.
+//
+// At every timestep, the block's output is used as a
+// query.
+// Each lane attends to the encoder outputs from the same
+// lane: attn produces a logit for every encoder timestep,
+// and the softmax of these logits is used to average the
+// encoder outputs into a context vector.
+// The output for each lane is the block's output followed
+// by the context vector.
+//
+// The encoder outputs are never stored all at once.
+// Instead, they are re-read in chunks of chunkSize
+// timesteps, both for the forward pass and during
+// back-propagation.
+// The decoder itself uses BPTT.
+//
+// If the encoder produces no timesteps, the context
+// vectors are empty and the outputs are simply the
+// outputs of the block.
+func Decode(enc lazyseq.Rereader, in lazyseq.Seq, block anyrnn.Block,
+	attn AttentionFunc, chunkSize int) lazyseq.Seq {
+	if chunkSize < 1 {
+		panic("invalid chunk size")
+	}
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	frag := &decodeFrag{
+		Enc:       enc,
+		Block:     block,
+		Attn:      attn,
+		ChunkSize: chunkSize,
+		Out:       outChan,
+		Done:      doneChan,
+		V:         anydiff.VarSet{},
+	}
+	go frag.forward(in.Forward(), outChan, doneChan)
+	return FragmentSeq(in, block, frag)
+}
+
+type decodeFrag struct {
+	Enc       lazyseq.Rereader
+	Block     anyrnn.Block
+	Attn      AttentionFunc
+	ChunkSize int
+	Out       <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done    <-chan struct{}
+	EncLen  int
+	EncSize int
+	Steps   []*decodeStep
+	V       anydiff.VarSet
+}
+
+// decodeStep stores the information needed to
+// back-propagate through one decoder timestep.
+type decodeStep struct {
+	Res     anyrnn.Res
+	Present []bool
+	Context anyvec.Vector
+
+	// LogNorm stores the log of the softmax denominator
+	// for every lane.
+	LogNorm []float64
+}
+
+func (d *decodeFrag) Forward() <-chan *anyseq.Batch {
+	return d.Out
+}
+
+func (d *decodeFrag) Vars() anydiff.VarSet {
+	<-d.Done
+	return d.V
+}
+
+func (d *decodeFrag) Propagate(down chan<- *anyseq.Batch, up <-chan *anyseq.Batch,
+	stateUp anyrnn.StateGrad, grad lazyseq.Grad) anyrnn.StateGrad {
+	for _ = range d.Forward() {
+	}
+
+	ctxGrads := make([]anyvec.Vector, len(d.Steps))
+	nextGrad := stateUp
+	for t := len(d.Steps) - 1; t >= 0; t-- {
+		step := d.Steps[t]
+		pres := step.Res.State().Present()
+		if nextGrad != nil && nextGrad.Present().NumPresent() != pres.NumPresent() {
+			nextGrad = nextGrad.Expand(pres)
+		}
+		upBatch, ok := <-up
+		if !ok {
+			panic("not enough upstream batches")
+		}
+		n := upBatch.NumPresent()
+		querySize := step.Res.Output().Len() / n
+		queryGrad, ctxGrad := splitRows(upBatch.Packed, n, querySize, d.EncSize)
+		queryGrad.Add(d.propagateQuery(step, ctxGrad, grad))
+		ctxGrads[t] = ctxGrad
+
+		var inDown anyvec.Vector
+		grad.Use(func(g anydiff.Grad) {
+			inDown, nextGrad = step.Res.Propagate(queryGrad, nextGrad, g)
+		})
+		if down != nil {
+			down <- &anyseq.Batch{
+				Packed:  inDown,
+				Present: upBatch.Present,
+			}
+		}
+	}
+
+	var needEnc bool
+	grad.Use(func(g anydiff.Grad) {
+		needEnc = g.Intersects(d.Enc.Vars())
+	})
+	if needEnc {
+		d.propagateEncoder(ctxGrads, grad)
+	}
+
+	return nextGrad
+}
+
+func (d *decodeFrag) forward(in <-chan *anyseq.Batch, out chan<- *anyseq.Batch,
+	done chan<- struct{}) {
+	var encLanes int
+	for batch := range d.Enc.Forward() {
+		if d.EncLen == 0 {
+			encLanes = len(batch.Present)
+			d.EncSize = batch.Packed.Len() / batch.NumPresent()
+		}
+		d.EncLen++
+	}
+
+	var state anyrnn.State
+	for batch := range in {
+		if d.EncLen > 0 && len(batch.Present) != encLanes {
+			panic(fmt.Sprintf("decoder has %d lanes but encoder has %d",
+				len(batch.Present), encLanes))
+		}
+		if state == nil {
+			state = d.Block.Start(len(batch.Present))
+		}
+		if batch.NumPresent() != state.Present().NumPresent() {
+			state = state.Reduce(batch.Present)
+		}
+		t := len(d.Steps)
+		notify(d.Block, lazyseq.StepEvent, t)
+		res := d.Block.Step(state, batch.Packed)
+		notify(d.Block, lazyseq.SaveStateEvent, t)
+		state = res.State()
+
+		step := &decodeStep{Res: res, Present: batch.Present}
+		d.attend(step)
+		d.Steps = append(d.Steps, step)
+		d.V = anydiff.MergeVarSets(d.V, res.Vars())
+
+		n := batch.NumPresent()
+		out <- &anyseq.Batch{
+			Packed:  joinRows(n, res.Output(), step.Context),
+			Present: batch.Present,
+		}
+	}
+
+	d.V = anydiff.MergeVarSets(d.V, d.Enc.Vars())
+
+	close(done)
+	close(out)
+}
+
+// attend computes the context vectors for a step using
+// an online softmax over the encoder outputs.
+func (d *decodeFrag) attend(step *decodeStep) {
+	query := step.Res.Output()
+	c := query.Creator()
+	n := numPresent(step.Present)
+	querySize := query.Len() / n
+
+	maxes := make([]float64, len(step.Present))
+	sums := make([]float64, len(step.Present))
+	accs := make([]anyvec.Vector, len(step.Present))
+	for i, p := range step.Present {
+		if p {
+			maxes[i] = math.Inf(-1)
+			accs[i] = c.MakeVector(d.EncSize)
+		}
+	}
+
+	d.forEachEncoderStep(0, d.EncLen, func(_ int, encBatch *anyseq.Batch) {
+		lanes := commonLanes(step.Present, encBatch.Present)
+		if len(lanes) == 0 {
+			return
+		}
+		queries := laneRows(query, step.Present, lanes, querySize)
+		keys := laneRows(encBatch.Packed, encBatch.Present, lanes, d.EncSize)
+		logitsRes := d.Attn(anydiff.NewConst(queries), anydiff.NewConst(keys), len(lanes))
+		d.V = anydiff.MergeVarSets(d.V, logitsRes.Vars())
+		logits := numeric.Floats(logitsRes.Output())
+		for j, lane := range lanes {
+			logit := logits[j]
+			if logit > maxes[lane] {
+				scale := c.MakeNumeric(math.Exp(maxes[lane] - logit))
+				accs[lane].Scale(scale)
+				sums[lane] *= math.Exp(maxes[lane] - logit)
+				maxes[lane] = logit
+			}
+			weight := math.Exp(logit - maxes[lane])
+			row := keys.Slice(j*d.EncSize, (j+1)*d.EncSize).Copy()
+			row.Scale(c.MakeNumeric(weight))
+			accs[lane].Add(row)
+			sums[lane] += weight
+		}
+	})
+
+	step.LogNorm = make([]float64, len(step.Present))
+	var contexts []anyvec.Vector
+	for i, p := range step.Present {
+		if !p {
+			continue
+		}
+		if sums[i] > 0 {
+			accs[i].Scale(c.MakeNumeric(1 / sums[i]))
+			step.LogNorm[i] = maxes[i] + math.Log(sums[i])
+		}
+		contexts = append(contexts, accs[i])
+	}
+	step.Context = c.Concat(contexts...)
+}
+
+// propagateQuery back-propagates a context gradient
+// through the attention logits of a step.
+// It returns the gradient with respect to the query and
+// accumulates the gradients of the attention parameters.
+func (d *decodeFrag) propagateQuery(step *decodeStep, ctxGrad anyvec.Vector,
+	grad lazyseq.Grad) anyvec.Vector {
+	query := step.Res.Output()
+	c := query.Creator()
+	n := numPresent(step.Present)
+	querySize := query.Len() / n
+	queryGrad := c.MakeVector(query.Len())
+
+	d.forEachEncoderStep(0, d.EncLen, func(_ int, encBatch *anyseq.Batch) {
+		lanes := commonLanes(step.Present, encBatch.Present)
+		if len(lanes) == 0 {
+			return
+		}
+		queryVar := anydiff.NewVar(laneRows(query, step.Present, lanes, querySize))
+		keys := laneRows(encBatch.Packed, encBatch.Present, lanes, d.EncSize)
+		term := d.attentionTerm(step, lanes, queryVar, anydiff.NewConst(keys))
+		upstream := laneRows(ctxGrad, step.Present, lanes, d.EncSize)
+		grad.Use(func(g anydiff.Grad) {
+			g[queryVar] = c.MakeVector(queryVar.Vector.Len())
+			term.Propagate(upstream, g)
+			addLaneRows(queryGrad, step.Present, lanes, g[queryVar], querySize)
+			delete(g, queryVar)
+		})
+	})
+
+	return queryGrad
+}
+
+// propagateEncoder back-propagates the context gradients
+// into the encoder, one chunk at a time.
+func (d *decodeFrag) propagateEncoder(ctxGrads []anyvec.Vector, grad lazyseq.Grad) {
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.Enc.Propagate(downstream, grad)
+	}()
+
+	for start := ((d.EncLen - 1) / d.ChunkSize) * d.ChunkSize; start >= 0; start -= d.ChunkSize {
+		end := essentials.MinInt(d.EncLen, start+d.ChunkSize)
+		var batches []*anyseq.Batch
+		var encGrads []*anyseq.Batch
+		for batch := range d.Enc.Reread(start, end) {
+			c := batch.Packed.Creator()
+			batches = append(batches, batch)
+			encGrads = append(encGrads, &anyseq.Batch{
+				Packed:  c.MakeVector(batch.Packed.Len()),
+				Present: batch.Present,
+			})
+		}
+		for t, step := range d.Steps {
+			query := step.Res.Output()
+			querySize := query.Len() / numPresent(step.Present)
+			for i, encBatch := range batches {
+				lanes := commonLanes(step.Present, encBatch.Present)
+				if len(lanes) == 0 {
+					continue
+				}
+				queries := laneRows(query, step.Present, lanes, querySize)
+				keyVar := anydiff.NewVar(laneRows(encBatch.Packed, encBatch.Present,
+					lanes, d.EncSize))
+				term := d.attentionTerm(step, lanes, anydiff.NewConst(queries), keyVar)
+				g := anydiff.NewGrad(keyVar)
+				term.Propagate(laneRows(ctxGrads[t], step.Present, lanes, d.EncSize), g)
+				addLaneRows(encGrads[i].Packed, encBatch.Present, lanes, g[keyVar],
+					d.EncSize)
+			}
+		}
+		for i := len(encGrads) - 1; i >= 0; i-- {
+			downstream <- encGrads[i]
+		}
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+// attentionTerm creates a Res whose derivatives with
+// respect to the queries, keys, and attention parameters
+// match those of the context vectors, restricted to one
+// encoder timestep.
+//
+// For weights a_j = exp(logit_j - logNorm) and context c,
+// the term is sum_j a_j*(key_j - c), where c and logNorm
+// are treated as constants.
+func (d *decodeFrag) attentionTerm(step *decodeStep, lanes []int, queries,
+	keys anydiff.Res) anydiff.Res {
+	c := keys.Output().Creator()
+	logNorms := make([]float64, len(lanes))
+	for i, lane := range lanes {
+		logNorms[i] = step.LogNorm[lane]
+	}
+	contexts := laneRows(step.Context, step.Present, lanes, d.EncSize)
+
+	logits := d.Attn(queries, keys, len(lanes))
+	weights := anydiff.Exp(anydiff.Sub(logits,
+		anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(logNorms)))))
+	diffs := anydiff.Sub(keys, anydiff.NewConst(contexts))
+
+	var rows []anydiff.Res
+	for i := range lanes {
+		row := anydiff.Slice(diffs, i*d.EncSize, (i+1)*d.EncSize)
+		rows = append(rows, anydiff.ScaleRepeated(row, anydiff.Slice(weights, i, i+1)))
+	}
+	return anydiff.Concat(rows...)
+}
+
+// forEachEncoderStep re-reads the encoder in chunks and
+// calls f for every timestep in [start, end).
+func (d *decodeFrag) forEachEncoderStep(start, end int, f func(t int, b *anyseq.Batch)) {
+	for chunkStart := start; chunkStart < end; chunkStart += d.ChunkSize {
+		chunkEnd := essentials.MinInt(end, chunkStart+d.ChunkSize)
+		t := chunkStart
+		for batch := range d.Enc.Reread(chunkStart, chunkEnd) {
+			f(t, batch)
+			t++
+		}
+	}
+}
+
+// commonLanes finds the lanes which are present in both
+// present maps.
+func commonLanes(p1, p2 []bool) []int {
+	var res []int
+	for i, p := range p1 {
+		if p && p2[i] {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// laneRows extracts the rows of a packed vector which
+// correspond to the given lanes.
+func laneRows(packed anyvec.Vector, present []bool, lanes []int, rowSize int) anyvec.Vector {
+	rows := make([]anyvec.Vector, len(lanes))
+	for i, lane := range lanes {
+		start := laneIndex(present, lane) * rowSize
+		rows[i] = packed.Slice(start, start+rowSize)
+	}
+	return packed.Creator().Concat(rows...)
+}
+
+// addLaneRows is the inverse of laneRows.
+// It adds the rows to the corresponding rows of packed.
+func addLaneRows(packed anyvec.Vector, present []bool, lanes []int, rows anyvec.Vector,
+	rowSize int) {
+	for i, lane := range lanes {
+		start := laneIndex(present, lane) * rowSize
+		packed.Slice(start, start+rowSize).Add(rows.Slice(i*rowSize, (i+1)*rowSize))
+	}
+}
+
+// laneIndex finds the row of a lane in a packed vector.
+func laneIndex(present []bool, lane int) int {
+	var res int
+	for _, p := range present[:lane] {
+		if p {
+			res++
+		}
+	}
+	return res
+}
+
+// joinRows concatenates the rows of two packed vectors,
+// each with n rows.
+func joinRows(n int, v1, v2 anyvec.Vector) anyvec.Vector {
+	size1 := v1.Len() / n
+	size2 := v2.Len() / n
+	var parts []anyvec.Vector
+	for i := 0; i < n; i++ {
+		parts = append(parts, v1.Slice(i*size1, (i+1)*size1),
+			v2.Slice(i*size2, (i+1)*size2))
+	}
+	return v1.Creator().Concat(parts...)
+}
+
+// splitRows is the inverse of joinRows.
+func splitRows(v anyvec.Vector, n, size1, size2 int) (v1, v2 anyvec.Vector) {
+	var parts1, parts2 []anyvec.Vector
+	for i := 0; i < n; i++ {
+		start := i * (size1 + size2)
+		parts1 = append(parts1, v.Slice(start, start+size1))
+		parts2 = append(parts2, v.Slice(start+size1, start+size1+size2))
+	}
+	return v.Creator().Concat(parts1...), v.Creator().Concat(parts2...)
+}
+
+func numPresent(present []bool) int {
+	var res int
+	for _, p := range present {
+		if p {
+			res++
+		}
+	}
+	return res
+}
@@ -19,13 +19,30 @@ import (
 // which does not produce any output until the entire
 // input sequence has been generated.
 func BPTT(in lazyseq.Seq, block anyrnn.Block) lazyseq.Seq {
-	return rnnFragmentToSeq(in, block, bptt(in.Forward(), block, nil))
+	return FragmentSeq(in, block, BPTTFragment(0, in.Forward(), block, nil))
 }
 
-func bptt(in <-chan *anyseq.Batch, block anyrnn.Block, start anyrnn.State) rnnFragment {
+// BPTTFragment creates a Fragment which applies the block
+// to the inputs and stores every timestep for regular
+// back-propagation through time.
+//
+// The offset is the index of the first input in the
+// entire sequence, which is used to report events to
+// Observers.
+// For a RereaderFragment, this is its Offset field.
+//
+// The start argument may be nil if this is the beginning
+// of the sequence.
+func BPTTFragment(offset int, in <-chan *anyseq.Batch, block anyrnn.Block,
+	start anyrnn.State) Fragment {
 	outChan := make(chan *anyseq.Batch, 1)
 	doneChan := make(chan struct{})
-	frag := &bpttFrag{forward: outChan, done: doneChan, v: anydiff.VarSet{}}
+	frag := &bpttFrag{
+		offset:  offset,
+		forward: outChan,
+		done:    doneChan,
+		v:       anydiff.VarSet{},
+	}
 
 	go func() {
 		state := start
@@ -36,7 +53,10 @@ func bptt(in <-chan *anyseq.Batch, block anyrnn.Block, start anyrnn.State) rnnFr
 			if batch.NumPresent() != state.Present().NumPresent() {
 				state = state.Reduce(batch.Present)
 			}
+			t := offset + len(frag.reses)
+			notify(block, lazyseq.StepEvent, t)
 			res := block.Step(state, batch.Packed)
+			notify(block, lazyseq.SaveStateEvent, t)
 			frag.reses = append(frag.reses, res)
 			state = res.State()
 			outChan <- &anyseq.Batch{
@@ -53,6 +73,7 @@ func bptt(in <-chan *anyseq.Batch, block anyrnn.Block, start anyrnn.State) rnnFr
 }
 
 type bpttFrag struct {
+	offset  int
 	forward <-chan *anyseq.Batch
 
 	// Fields are immutable once done is closed.
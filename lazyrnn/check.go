@@ -0,0 +1,367 @@
+package lazyrnn
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/lazyseq"
+)
+
+// A Mismatch describes a difference between the results
+// of a Strategy and the results of BPTT.
+type Mismatch struct {
+	// Kind is "output", "input gradient", "parameter
+	// gradient", or "state gradient".
+	Kind string
+
+	// Time is the first timestep at which the results
+	// differ.
+	// It is -1 for parameter gradients.
+	// For state gradients, it is the first timestep of
+	// the fragment, since the gradient is with respect to
+	// the state before that timestep.
+	Time int
+
+	// Diff is the maximum absolute difference at Time.
+	Diff float64
+}
+
+// Error returns a description of the mismatch.
+func (m *Mismatch) Error() string {
+	if m.Time < 0 {
+		return fmt.Sprintf("%s mismatch (diff %g)", m.Kind, m.Diff)
+	}
+	return fmt.Sprintf("%s mismatch at timestep %d (diff %g)", m.Kind, m.Time, m.Diff)
+}
+
+// CheckedStrategy wraps a Strategy so that BPTT is run
+// alongside it on the same inputs.
+// The outputs and gradients of the two are compared, and
+// f is called for every kind of result that differs by
+// more than tol.
+// If f is nil, mismatches cause a panic.
+//
+// The gradients with respect to the start state of each
+// fragment are only compared if they are made up of
+// *anyrnn.VecState and anyrnn.StackGrad values.
+//
+// This is meant for debugging and for occasional sanity
+// checks during training.
+// Since it uses BPTT, it stores every timestep and every
+// upstream gradient, defeating the purpose of s.
+func CheckedStrategy(s Strategy, tol float64, f func(m *Mismatch)) Strategy {
+	if f == nil {
+		f = func(m *Mismatch) {
+			panic(m)
+		}
+	}
+	return func(in *RereaderFragment, b anyrnn.Block, start anyrnn.State) Fragment {
+		inA, inB := splitBatches(in.Forward)
+		actualIn := &RereaderFragment{
+			Offset:   in.Offset,
+			Forward:  inA,
+			Rereader: in.Rereader,
+		}
+		outChan := make(chan *anyseq.Batch, 1)
+		doneChan := make(chan struct{})
+		res := &checkedFrag{
+			Offset:   in.Offset,
+			Actual:   s(actualIn, b, start),
+			Expected: BPTTFragment(in.Offset, inB, b, start),
+			Tol:      tol,
+			Report:   f,
+			Out:      outChan,
+			Done:     doneChan,
+		}
+		go res.forward(outChan, doneChan)
+		return res
+	}
+}
+
+type checkedFrag struct {
+	Offset   int
+	Actual   Fragment
+	Expected Fragment
+	Tol      float64
+	Report   func(m *Mismatch)
+	Out      <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done     <-chan struct{}
+	NumSteps int
+}
+
+func (c *checkedFrag) Forward() <-chan *anyseq.Batch {
+	return c.Out
+}
+
+func (c *checkedFrag) Vars() anydiff.VarSet {
+	return c.Actual.Vars()
+}
+
+func (c *checkedFrag) Propagate(down chan<- *anyseq.Batch, up <-chan *anyseq.Batch,
+	stateUp anyrnn.StateGrad, grad lazyseq.Grad) anyrnn.StateGrad {
+	for _ = range c.Forward() {
+	}
+
+	upstream := make([]*anyseq.Batch, c.NumSteps)
+	for i := range upstream {
+		var ok bool
+		upstream[i], ok = <-up
+		if !ok {
+			panic("not enough upstream batches")
+		}
+	}
+
+	var actualGrad, expectedGrad anydiff.Grad
+	grad.Use(func(g anydiff.Grad) {
+		actualGrad = zeroGrad(g)
+		expectedGrad = zeroGrad(g)
+	})
+
+	expectedStateUp := copyStateGrad(stateUp)
+	actualDown, stateDown := propagateCollect(c.Actual, upstream, stateUp, actualGrad)
+	expectedDown, expectedStateDown := propagateCollect(c.Expected, upstream,
+		expectedStateUp, expectedGrad)
+
+	c.compareDownstream(actualDown, expectedDown)
+	c.compareGrads(actualGrad, expectedGrad)
+	c.compareStateGrads(stateDown, expectedStateDown)
+
+	grad.Use(func(g anydiff.Grad) {
+		for v, vec := range actualGrad {
+			g[v].Add(vec)
+		}
+	})
+	if down != nil {
+		for _, batch := range actualDown {
+			down <- batch
+		}
+	}
+
+	return stateDown
+}
+
+func (c *checkedFrag) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	reported := false
+	for actual := range c.Actual.Forward() {
+		expected := <-c.Expected.Forward()
+		if !reported {
+			if diff := batchDiff(actual, expected); diff > c.Tol {
+				reported = true
+				c.Report(&Mismatch{Kind: "output", Time: c.Offset + c.NumSteps, Diff: diff})
+			}
+		}
+		c.NumSteps++
+		out <- actual
+	}
+	for _ = range c.Expected.Forward() {
+	}
+	close(done)
+	close(out)
+}
+
+// compareDownstream compares downstream batches, which
+// are ordered last-to-first.
+func (c *checkedFrag) compareDownstream(actual, expected []*anyseq.Batch) {
+	for i := len(actual) - 1; i >= 0; i-- {
+		if diff := batchDiff(actual[i], expected[i]); diff > c.Tol {
+			c.Report(&Mismatch{
+				Kind: "input gradient",
+				Time: c.Offset + len(actual) - (i + 1),
+				Diff: diff,
+			})
+			return
+		}
+	}
+}
+
+func (c *checkedFrag) compareGrads(actual, expected anydiff.Grad) {
+	var maxDiff float64
+	for v, vec := range actual {
+		maxDiff = math.Max(maxDiff, vecDiff(vec, expected[v]))
+	}
+	if maxDiff > c.Tol {
+		c.Report(&Mismatch{Kind: "parameter gradient", Time: -1, Diff: maxDiff})
+	}
+}
+
+func (c *checkedFrag) compareStateGrads(actual, expected anyrnn.StateGrad) {
+	if diff, ok := stateGradDiff(actual, expected); ok && diff > c.Tol {
+		c.Report(&Mismatch{Kind: "state gradient", Time: c.Offset, Diff: diff})
+	}
+}
+
+// propagateCollect propagates through a Fragment and
+// returns the resulting downstream batches.
+func propagateCollect(f Fragment, upstream []*anyseq.Batch, stateUp anyrnn.StateGrad,
+	g anydiff.Grad) ([]*anyseq.Batch, anyrnn.StateGrad) {
+	upChan := make(chan *anyseq.Batch, len(upstream))
+	for _, batch := range upstream {
+		upChan <- &anyseq.Batch{Packed: batch.Packed.Copy(), Present: batch.Present}
+	}
+	close(upChan)
+
+	downChan := make(chan *anyseq.Batch, 1)
+	var downstream []*anyseq.Batch
+	doneChan := make(chan struct{})
+	go func() {
+		for batch := range downChan {
+			downstream = append(downstream, batch)
+		}
+		close(doneChan)
+	}()
+	stateDown := f.Propagate(downChan, upChan, stateUp, lazyseq.NewGrad(g))
+	close(downChan)
+	<-doneChan
+
+	return downstream, stateDown
+}
+
+// splitBatches sends every batch from in to two channels.
+//
+// Batches are queued for each channel as necessary, so
+// that neither reader has to keep pace with the other.
+func splitBatches(in <-chan *anyseq.Batch) (<-chan *anyseq.Batch, <-chan *anyseq.Batch) {
+	outA := make(chan *anyseq.Batch)
+	outB := make(chan *anyseq.Batch)
+	go func() {
+		var queueA, queueB []*anyseq.Batch
+		for in != nil || len(queueA) > 0 || len(queueB) > 0 {
+			var sendA, sendB chan<- *anyseq.Batch
+			var nextA, nextB *anyseq.Batch
+			if len(queueA) > 0 {
+				sendA = outA
+				nextA = queueA[0]
+			}
+			if len(queueB) > 0 {
+				sendB = outB
+				nextB = queueB[0]
+			}
+			select {
+			case batch, ok := <-in:
+				if ok {
+					queueA = append(queueA, batch)
+					queueB = append(queueB, batch)
+				} else {
+					in = nil
+				}
+			case sendA <- nextA:
+				queueA[0] = nil
+				queueA = queueA[1:]
+			case sendB <- nextB:
+				queueB[0] = nil
+				queueB = queueB[1:]
+			}
+		}
+		close(outA)
+		close(outB)
+	}()
+	return outA, outB
+}
+
+// copyStateGrad copies a state gradient so that it can be
+// propagated through more than once.
+//
+// Only gradients built out of *anyrnn.VecState and
+// anyrnn.StackGrad can be copied.
+// Other gradients are returned as-is, so the comparison
+// may be thrown off if a Block modifies them.
+func copyStateGrad(g anyrnn.StateGrad) anyrnn.StateGrad {
+	switch g := g.(type) {
+	case *anyrnn.VecState:
+		return &anyrnn.VecState{Vector: g.Vector.Copy(), PresentMap: g.PresentMap}
+	case anyrnn.StackGrad:
+		res := make(anyrnn.StackGrad, len(g))
+		for i, x := range g {
+			res[i] = copyStateGrad(x)
+		}
+		return res
+	default:
+		return g
+	}
+}
+
+func zeroGrad(g anydiff.Grad) anydiff.Grad {
+	res := anydiff.Grad{}
+	for v, vec := range g {
+		res[v] = vec.Creator().MakeVector(vec.Len())
+	}
+	return res
+}
+
+// stateGradDiff computes the maximum absolute difference
+// between two state gradients.
+// It returns false if the gradients cannot be compared.
+//
+// Like copyStateGrad, it only understands gradients built
+// out of *anyrnn.VecState and anyrnn.StackGrad.
+func stateGradDiff(g1, g2 anyrnn.StateGrad) (float64, bool) {
+	if g1 == nil || g2 == nil {
+		if g1 == nil && g2 == nil {
+			return 0, true
+		}
+		return math.Inf(1), true
+	}
+	switch g1 := g1.(type) {
+	case *anyrnn.VecState:
+		g2, ok := g2.(*anyrnn.VecState)
+		if !ok {
+			return math.Inf(1), true
+		}
+		return batchDiff(
+			&anyseq.Batch{Packed: g1.Vector, Present: g1.PresentMap},
+			&anyseq.Batch{Packed: g2.Vector, Present: g2.PresentMap},
+		), true
+	case anyrnn.StackGrad:
+		g2, ok := g2.(anyrnn.StackGrad)
+		if !ok || len(g1) != len(g2) {
+			return math.Inf(1), true
+		}
+		var maxDiff float64
+		for i, x := range g1 {
+			diff, ok := stateGradDiff(x, g2[i])
+			if !ok {
+				return 0, false
+			}
+			maxDiff = math.Max(maxDiff, diff)
+		}
+		return maxDiff, true
+	default:
+		return 0, false
+	}
+}
+
+func batchDiff(b1, b2 *anyseq.Batch) float64 {
+	if len(b1.Present) != len(b2.Present) {
+		return math.Inf(1)
+	}
+	for i, p := range b1.Present {
+		if p != b2.Present[i] {
+			return math.Inf(1)
+		}
+	}
+	return vecDiff(b1.Packed, b2.Packed)
+}
+
+func vecDiff(v1, v2 anyvec.Vector) float64 {
+	if v1.Len() != v2.Len() {
+		return math.Inf(1)
+	} else if v1.Len() == 0 {
+		return 0
+	}
+	diff := v1.Copy()
+	diff.Sub(v2)
+	switch max := anyvec.AbsMax(diff).(type) {
+	case float32:
+		return float64(max)
+	case float64:
+		return max
+	default:
+		panic(fmt.Sprintf("unsupported numeric type: %T", max))
+	}
+}
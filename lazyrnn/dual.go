@@ -0,0 +1,255 @@
+package lazyrnn
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/lazyseq"
+)
+
+// A DualState is a hidden state paired with its tangent.
+type DualState struct {
+	State   anyrnn.State
+	Tangent anyrnn.State
+}
+
+// Reduce reduces both the state and its tangent.
+func (d *DualState) Reduce(p anyrnn.PresentMap) *DualState {
+	return &DualState{
+		State:   d.State.Reduce(p),
+		Tangent: d.Tangent.Reduce(p),
+	}
+}
+
+// A DualStepResult is the result of a DualBlock step.
+type DualStepResult struct {
+	Output        anyvec.Vector
+	OutputTangent anyvec.Vector
+	State         *DualState
+}
+
+// A DualBlock is an RNN block which can carry tangents
+// through its steps exactly, in forward-mode.
+//
+// The tangents of the block's parameters are part of the
+// block itself, since they are specific to the
+// directional derivative being computed.
+type DualBlock interface {
+	// StartDual returns the start state for n sequences,
+	// along with its tangent.
+	StartDual(n int) *DualState
+
+	// StepDual applies the block for a single timestep.
+	// It computes the tangents of the output and the new
+	// state from the tangents of s and in.
+	StepDual(s *DualState, in, inTangent anyvec.Vector) *DualStepResult
+}
+
+// Dual applies the block to a DualSeq, producing the
+// directional derivative of the outputs alongside the
+// outputs themselves.
+//
+// Every strategy in this package computes the same
+// forward pass, so the tangents apply to BPTT, HSM, and
+// any other Strategy alike.
+// Only the latest state and its tangent are stored.
+//
+// For blocks which do not implement DualBlock, such as
+// the blocks in anyrnn, see ApplyDual.
+func Dual(in lazyseq.DualSeq, block DualBlock) lazyseq.DualSeq {
+	outChan := make(chan *lazyseq.DualBatch, 1)
+	go func() {
+		var state *DualState
+		for batch := range in.Forward() {
+			if state == nil {
+				state = block.StartDual(len(batch.Present))
+			}
+			if batch.NumPresent() != state.State.Present().NumPresent() {
+				state = state.Reduce(batch.Present)
+			}
+			res := block.StepDual(state, batch.Packed, batch.Tangent)
+			state = res.State
+			outChan <- &lazyseq.DualBatch{
+				Packed:  res.Output,
+				Tangent: res.OutputTangent,
+				Present: batch.Present,
+			}
+		}
+		close(outChan)
+	}()
+	return lazyseq.DualChan(in.Creator(), outChan)
+}
+
+// ApplyDual uses a Strategy to apply a block to a
+// sequence, producing the directional derivative of the
+// outputs alongside the outputs themselves.
+//
+// Unlike Dual, this works for any anyrnn.Block.
+// The tangents of the outputs account for inTangent, the
+// tangent of in, and for the tangents in t.
+// Variables upon which in depends are included, as are
+// the block's parameters.
+// If inTangent is nil, it is treated as zero.
+//
+// Since anyrnn blocks only support reverse-mode, the
+// tangent at each timestep is computed by running the
+// strategy on the inputs up to that timestep and
+// back-propagating once per output component.
+// Each pass is exact, and memory usage is bounded by the
+// strategy, but the total time is quadratic in the
+// sequence length.
+// Thus, ApplyDual is only practical for short sequences
+// with small outputs.
+func ApplyDual(s Strategy, in, inTangent lazyseq.Rereader, b anyrnn.Block,
+	t lazyseq.Tangents) lazyseq.DualSeq {
+	c := in.Creator()
+	var eps *anydiff.Var
+	if inTangent != nil {
+		// The inputs are offset by eps times their tangents,
+		// so that the derivative with respect to eps is the
+		// Jacobian-vector product for the inputs.
+		eps = anydiff.NewVar(c.MakeVector(1))
+		in = lazyseq.MapN(func(n int, v ...anydiff.Res) anydiff.Res {
+			return anydiff.Add(v[0], anydiff.ScaleRepeated(v[1], eps))
+		}, in, inTangent)
+	}
+
+	outChan := make(chan *lazyseq.DualBatch, 1)
+	go func() {
+		var shapes []*anyseq.Batch
+		for batch := range in.Forward() {
+			shapes = append(shapes, zeroBatch(batch))
+		}
+		for step := range shapes {
+			prefix := ApplyStrategy(s, newPrefixRereader(in, shapes, step+1), b)
+			var outShapes []*anyseq.Batch
+			var out *anyseq.Batch
+			for batch := range prefix.Forward() {
+				outShapes = append(outShapes, zeroBatch(batch))
+				out = batch
+			}
+			outChan <- &lazyseq.DualBatch{
+				Packed:  out.Packed,
+				Tangent: prefixTangent(prefix, outShapes, eps, t),
+				Present: out.Present,
+			}
+		}
+		close(outChan)
+	}()
+	return lazyseq.DualChan(c, outChan)
+}
+
+// prefixTangent computes the tangent of the last output
+// of a Seq by back-propagating a one-hot upstream vector
+// for every component of that output.
+func prefixTangent(seq lazyseq.Seq, outShapes []*anyseq.Batch, eps *anydiff.Var,
+	t lazyseq.Tangents) anyvec.Vector {
+	c := seq.Creator()
+	vars := t.Vars(seq.Vars())
+	if eps != nil {
+		vars = append(vars, eps)
+	}
+	last := outShapes[len(outShapes)-1]
+	res := c.MakeVector(last.Packed.Len())
+	if len(vars) == 0 {
+		return res
+	}
+	for i := 0; i < res.Len(); i++ {
+		upstream := make(chan *anyseq.Batch, len(outShapes))
+		oneHot := c.MakeVector(res.Len())
+		oneHot.Slice(i, i+1).AddScalar(c.MakeNumeric(1))
+		upstream <- &anyseq.Batch{Packed: oneHot, Present: last.Present}
+		for j := len(outShapes) - 2; j >= 0; j-- {
+			upstream <- zeroBatch(outShapes[j])
+		}
+		close(upstream)
+
+		g := anydiff.NewGrad(vars...)
+		seq.Propagate(upstream, lazyseq.NewGrad(g))
+		component := res.Slice(i, i+1)
+		for _, v := range vars {
+			if v == eps {
+				component.Add(g[v])
+			} else {
+				component.AddScalar(g[v].Dot(t[v]))
+			}
+		}
+	}
+	return res
+}
+
+// zeroBatch creates a batch of zeros with the same shape
+// as b.
+func zeroBatch(b *anyseq.Batch) *anyseq.Batch {
+	return &anyseq.Batch{
+		Packed:  b.Packed.Creator().MakeVector(b.Packed.Len()),
+		Present: b.Present,
+	}
+}
+
+// prefixRereader is a Rereader for the first Len
+// timesteps of a Rereader whose forward pass is done.
+//
+// Unlike lazyseq.Slice, it does not read the forward
+// pass of the wrapped Rereader, so that any number of
+// prefixes can be created.
+type prefixRereader struct {
+	lazyseq.Rereader
+	Shapes []*anyseq.Batch
+	Len    int
+	Out    <-chan *anyseq.Batch
+}
+
+func newPrefixRereader(r lazyseq.Rereader, shapes []*anyseq.Batch,
+	length int) *prefixRereader {
+	return &prefixRereader{
+		Rereader: r,
+		Shapes:   shapes,
+		Len:      length,
+		Out:      r.Reread(0, length),
+	}
+}
+
+func (p *prefixRereader) Forward() <-chan *anyseq.Batch {
+	return p.Out
+}
+
+func (p *prefixRereader) Propagate(upstream <-chan *anyseq.Batch, grad lazyseq.Grad) {
+	for _ = range p.Forward() {
+	}
+
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.Rereader.Propagate(downstream, grad)
+	}()
+
+	for t := len(p.Shapes) - 1; t >= p.Len; t-- {
+		downstream <- zeroBatch(p.Shapes[t])
+	}
+	for t := p.Len - 1; t >= 0; t-- {
+		u, ok := <-upstream
+		if !ok {
+			panic("not enough upstream batches")
+		}
+		downstream <- u
+	}
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+func (p *prefixRereader) Reread(start, end int) <-chan *anyseq.Batch {
+	if start < 0 || end < start || end > p.Len {
+		panic("slice bounds out of range")
+	}
+	return p.Rereader.Reread(start, end)
+}
@@ -10,11 +10,17 @@ import (
 	"github.com/unixpickle/lazyseq"
 )
 
-// An rnnFragment is the result of running an RNN on a
+// A Fragment is the result of running an RNN on a
 // sub-range of a sequence.
 // It is similar to a Seq, but with more flexible
 // back-propagation.
-type rnnFragment interface {
+//
+// Fragments are the building blocks of checkpointing
+// strategies.
+// A strategy decides how to evaluate a range of inputs
+// and how much to remember about it, and its Fragment
+// decides how to recompute what it forgot.
+type Fragment interface {
 	// Forward is like Seq.Forward.
 	Forward() <-chan *anyseq.Batch
 
@@ -36,17 +42,44 @@ type rnnFragment interface {
 	// Unlike in Seq.Propagate, the upstream channel may
 	// be left open even after Propagate is done with it.
 	//
+	// The stateUp argument is the gradient of the state
+	// after the last timestep, or nil if there is no
+	// such gradient.
+	//
 	// The downstream state is returned.
 	Propagate(down chan<- *anyseq.Batch, up <-chan *anyseq.Batch,
 		stateUp anyrnn.StateGrad, grad lazyseq.Grad) anyrnn.StateGrad
 }
 
-// rereaderFragment represents a fragment of a Rereader.
+// A Strategy produces a Fragment for a range of inputs.
+//
+// The start argument is the state before the first
+// input, or nil if the range starts at the beginning of
+// the sequence.
+type Strategy func(in *RereaderFragment, b anyrnn.Block, start anyrnn.State) Fragment
+
+// BPTTStrategy is a Strategy which stores every timestep,
+// i.e. which uses regular back-propagation through time.
+func BPTTStrategy(in *RereaderFragment, b anyrnn.Block, start anyrnn.State) Fragment {
+	return BPTTFragment(in.Offset, in.Forward, b, start)
+}
+
+// ApplyStrategy uses a Strategy to apply the block to
+// the entire input sequence.
+func ApplyStrategy(s Strategy, in lazyseq.Rereader, b anyrnn.Block) lazyseq.Seq {
+	inFrag := &RereaderFragment{
+		Forward:  in.Forward(),
+		Rereader: in,
+	}
+	return FragmentSeq(in, b, s(inFrag, b, nil))
+}
+
+// RereaderFragment represents a fragment of a Rereader.
 //
 // The fragment may be from the forward pass, or the
 // forward pass may have already happened.
 // The only difference is the source of the Forward field.
-type rereaderFragment struct {
+type RereaderFragment struct {
 	// Offset is the start index in the Rereader.
 	Offset int
 
@@ -57,18 +90,37 @@ type rereaderFragment struct {
 	Rereader lazyseq.Rereader
 }
 
-func rnnFragmentToSeq(in lazyseq.Seq, block anyrnn.Block, r rnnFragment) lazyseq.Seq {
+// Slice creates a RereaderFragment for a sub-range of r.
+// The start and end indices are relative to r.Offset.
+//
+// The Forward field of the result is produced by
+// re-reading the underlying Rereader.
+func (r *RereaderFragment) Slice(start, end int) *RereaderFragment {
+	return &RereaderFragment{
+		Offset:   r.Offset + start,
+		Forward:  r.Rereader.Reread(r.Offset+start, r.Offset+end),
+		Rereader: r.Rereader,
+	}
+}
+
+// FragmentSeq creates a Seq from a Fragment which covers
+// the entirety of the sequence in.
+//
+// The block is used to propagate through the start
+// state, and in is used to propagate through the
+// inputs.
+func FragmentSeq(in lazyseq.Seq, block anyrnn.Block, f Fragment) lazyseq.Seq {
 	return &rnnFragSeq{
 		In:    in,
 		Block: block,
-		Frag:  r,
+		Frag:  f,
 	}
 }
 
 type rnnFragSeq struct {
 	In    lazyseq.Seq
 	Block anyrnn.Block
-	Frag  rnnFragment
+	Frag  Fragment
 
 	VLock sync.Mutex
 	V     anydiff.VarSet
@@ -42,18 +42,22 @@ func FixedHSM(intervalSize int, lazyBPTT bool, in lazyseq.Rereader,
 // store more internal states or inputs than it needs to.
 func RecursiveHSM(intervalSize, numPartitions int, lazyBPTT bool,
 	in lazyseq.Rereader, b anyrnn.Block) lazyseq.Seq {
+	return ApplyStrategy(HSMStrategy(intervalSize, numPartitions, lazyBPTT), in, b)
+}
+
+// HSMStrategy creates a Strategy which performs recursive
+// hidden state memorization with the given arguments.
+// See RecursiveHSM for details.
+func HSMStrategy(intervalSize, numPartitions int, lazyBPTT bool) Strategy {
 	if intervalSize < 1 {
 		panic("invalid interval size")
 	}
 	if numPartitions < 2 {
 		panic("invalid number of partitions")
 	}
-	inFrag := &rereaderFragment{
-		Forward:  in.Forward(),
-		Rereader: in,
+	return func(in *RereaderFragment, b anyrnn.Block, start anyrnn.State) Fragment {
+		return recHSM(intervalSize, numPartitions, lazyBPTT, in, b, start)
 	}
-	frag := recHSM(intervalSize, numPartitions, lazyBPTT, inFrag, b, nil)
-	return rnnFragmentToSeq(in, b, frag)
 }
 
 // recHSM applies recursive hidden-state memorization
@@ -61,8 +65,8 @@ func RecursiveHSM(intervalSize, numPartitions int, lazyBPTT bool,
 //
 // The start argument may be nil if this is the beginning
 // of the sequence.
-func recHSM(interval, partitions int, lazyBPTT bool, in *rereaderFragment,
-	block anyrnn.Block, start anyrnn.State) rnnFragment {
+func recHSM(interval, partitions int, lazyBPTT bool, in *RereaderFragment,
+	block anyrnn.Block, start anyrnn.State) Fragment {
 	outChan := make(chan *anyseq.Batch, 1)
 	doneChan := make(chan struct{})
 	res := &recHSMFrag{
@@ -78,9 +82,9 @@ func recHSM(interval, partitions int, lazyBPTT bool, in *rereaderFragment,
 	return res
 }
 
-// recHSMFrag is an rnnFragment for recursive HSM.
+// recHSMFrag is a Fragment for recursive HSM.
 type recHSMFrag struct {
-	In         *rereaderFragment
+	In         *RereaderFragment
 	Out        <-chan *anyseq.Batch
 	Partitions int
 	Interval   int
@@ -113,24 +117,20 @@ func (r *recHSMFrag) Propagate(down chan<- *anyseq.Batch, up <-chan *anyseq.Batc
 	for i := len(r.Saved) - 1; i >= 0; i-- {
 		frag := r.subFragment(i*r.Interval, nextIdx, r.Saved[i])
 		nextGrad = frag.Propagate(down, up, nextGrad, grad)
+		notifyFreed(r.Block, frag)
 		nextIdx = i * r.Interval
 	}
 	return nextGrad
 }
 
-func (r *recHSMFrag) subFragment(start, end int, state anyrnn.State) rnnFragment {
-	inChan := r.In.Rereader.Reread(start+r.In.Offset, end+r.In.Offset)
+func (r *recHSMFrag) subFragment(start, end int, state anyrnn.State) Fragment {
+	inFrag := r.In.Slice(start, end)
 	if end-start <= 1 || (end-start <= r.Partitions && !r.LazyBPTT) {
-		return bptt(inChan, r.Block, state)
+		return BPTTFragment(inFrag.Offset, inFrag.Forward, r.Block, state)
 	} else {
 		// TODO: look into different ways of determining interval,
 		// i.e. different rounding strategies.
 		interval := essentials.MaxInt(1, (end-start)/r.Partitions)
-		inFrag := &rereaderFragment{
-			Offset:   r.In.Offset + start,
-			Forward:  inChan,
-			Rereader: r.In.Rereader,
-		}
 		return recHSM(interval, r.Partitions, r.LazyBPTT, inFrag, r.Block, state)
 	}
 }
@@ -144,11 +144,14 @@ func (r *recHSMFrag) forward(outChan chan<- *anyseq.Batch, doneChan chan<- struc
 		if state.Present().NumPresent() != input.NumPresent() {
 			state = state.Reduce(input.Present)
 		}
+		t := r.In.Offset + r.NumSteps
 		if r.NumSteps%r.Interval == 0 {
+			notify(r.Block, lazyseq.SaveStateEvent, t)
 			r.Saved = append(r.Saved, state)
 		}
 		r.NumSteps++
 
+		notify(r.Block, lazyseq.StepEvent, t)
 		res := r.Block.Step(state, input.Packed)
 		r.V = anydiff.MergeVarSets(r.V, res.Vars())
 		state = res.State()
@@ -0,0 +1,50 @@
+// Command hsmplan prints the memory/compute tradeoff of
+// hidden state memorization for a given sequence length.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func main() {
+	var seqLen int
+	var maxPartitions int
+	var memory int
+	flag.IntVar(&seqLen, "len", 1024, "sequence length")
+	flag.IntVar(&maxPartitions, "partitions", 8, "maximum number of partitions")
+	flag.IntVar(&memory, "memory", -1, "memory budget in timesteps (-1 for none)")
+	flag.Parse()
+
+	plans := lazyrnn.Plans(seqLen, maxPartitions)
+	var recommended *lazyrnn.Plan
+	if memory >= 0 {
+		recommended = lazyrnn.RecommendFrom(plans, memory)
+		if recommended == nil {
+			fmt.Fprintln(os.Stderr, "no plan fits in the memory budget")
+		}
+	}
+
+	bptt := lazyrnn.BPTTCost(seqLen)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "interval\tpartitions\tlazy\tstates\tinputs\tsteps\tslowdown\t")
+	for _, p := range plans {
+		marker := ""
+		if p == recommended {
+			marker = "<- recommended"
+		}
+		config := fmt.Sprintf("%d\t%d\t%v", p.IntervalSize, p.NumPartitions,
+			p.LazyBPTT)
+		if p.BPTT {
+			config = "bptt\t-\t-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.2fx\t%s\n", config,
+			p.Cost.PeakStates, p.Cost.PeakInputs, p.Cost.Steps,
+			float64(p.Cost.Steps)/float64(bptt.Steps), marker)
+	}
+	w.Flush()
+}
@@ -0,0 +1,54 @@
+package lazyrnn
+
+import (
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/lazyseq"
+)
+
+type observedBlock struct {
+	anyrnn.Block
+	Observer lazyseq.Observer
+}
+
+// Observe attaches an Observer to a Block.
+//
+// When the strategies in this package are used with the
+// resulting Block, they report every Step() call and
+// every stored or freed hidden state to the Observer.
+// The Block behaves exactly like b in every other way.
+func Observe(b anyrnn.Block, o lazyseq.Observer) anyrnn.Block {
+	return &observedBlock{Block: b, Observer: o}
+}
+
+// Parameters returns the parameters of the wrapped
+// Block, if it has any.
+func (o *observedBlock) Parameters() []*anydiff.Var {
+	if p, ok := o.Block.(anynet.Parameterizer); ok {
+		return p.Parameters()
+	}
+	return nil
+}
+
+// notify reports an event if b is an observed Block.
+func notify(b anyrnn.Block, kind lazyseq.EventKind, time int) {
+	if o, ok := b.(*observedBlock); ok {
+		o.Observer.Observe(kind, time)
+	}
+}
+
+// notifyFreed reports that all of the states stored by a
+// fragment have been freed.
+func notifyFreed(b anyrnn.Block, f Fragment) {
+	switch f := f.(type) {
+	case *bpttFrag:
+		for i := range f.reses {
+			notify(b, lazyseq.FreeStateEvent, f.offset+i)
+		}
+	case *recHSMFrag:
+		for i := range f.Saved {
+			notify(b, lazyseq.FreeStateEvent, f.In.Offset+i*f.Interval)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package lazyrnn
+
+import (
+	"sort"
+
+	"github.com/unixpickle/essentials"
+)
+
+// Cost describes the resources that a strategy uses to
+// apply an RNN block to a sequence and back-propagate
+// through the result.
+//
+// Costs are measured in timesteps, not in bytes.
+// Multiply by the size of a hidden state (or an input)
+// to get an estimate of actual memory usage.
+type Cost struct {
+	// PeakStates is the maximum number of hidden states
+	// which are stored at once.
+	PeakStates int
+
+	// PeakInputs is the maximum number of input vectors
+	// which are stored at once.
+	PeakInputs int
+
+	// Steps is the total number of Block.Step calls.
+	Steps int
+}
+
+// Memory returns the total number of stored timesteps,
+// counting both states and inputs.
+func (c Cost) Memory() int {
+	return c.PeakStates + c.PeakInputs
+}
+
+// BPTTCost computes the cost of BPTT for a sequence of
+// length seqLen.
+func BPTTCost(seqLen int) Cost {
+	return Cost{PeakStates: seqLen, PeakInputs: seqLen, Steps: seqLen}
+}
+
+// FixedHSMCost computes the cost of FixedHSM for a
+// sequence of length seqLen.
+func FixedHSMCost(seqLen, intervalSize int, lazyBPTT bool) Cost {
+	return RecursiveHSMCost(seqLen, intervalSize, intervalSize+1, lazyBPTT)
+}
+
+// RecursiveHSMCost computes the cost of RecursiveHSM for
+// a sequence of length seqLen.
+//
+// The cost is computed by simulating the recursion that
+// RecursiveHSM performs, without running any RNN.
+func RecursiveHSMCost(seqLen, intervalSize, numPartitions int, lazyBPTT bool) Cost {
+	if intervalSize < 1 {
+		panic("invalid interval size")
+	}
+	if numPartitions < 2 {
+		panic("invalid number of partitions")
+	}
+	sim := &hsmSimulator{
+		Partitions: numPartitions,
+		LazyBPTT:   lazyBPTT,
+		Cache:      map[[2]int]Cost{},
+	}
+	return sim.Cost(seqLen, intervalSize)
+}
+
+// A Plan is a configuration for RecursiveHSM or plain
+// BPTT, paired with its cost.
+type Plan struct {
+	// BPTT is set if the plan uses BPTTStrategy, in which
+	// case the HSM fields are unused.
+	BPTT bool
+
+	IntervalSize  int
+	NumPartitions int
+	LazyBPTT      bool
+
+	Cost Cost
+}
+
+// Strategy creates the Strategy described by the plan.
+func (p *Plan) Strategy() Strategy {
+	if p.BPTT {
+		return BPTTStrategy
+	}
+	return HSMStrategy(p.IntervalSize, p.NumPartitions, p.LazyBPTT)
+}
+
+// Plans computes the memory/compute tradeoff for a
+// sequence of length seqLen.
+//
+// The result contains the configurations (BPTT and
+// RecursiveHSM, including FixedHSM) which are not beaten
+// in both Memory() and Steps by any other configuration.
+// Since BPTT takes the fewest steps, it is always the
+// first plan.
+// It is sorted from most to least memory.
+//
+// The maxPartitions argument limits the numPartitions
+// values that are considered, aside from the special
+// values used by FixedHSM.
+func Plans(seqLen, maxPartitions int) []*Plan {
+	all := []*Plan{{BPTT: true, Cost: BPTTCost(seqLen)}}
+	for interval := 1; interval <= essentials.MaxInt(1, seqLen); interval++ {
+		partitions := []int{interval + 1}
+		for p := 2; p <= maxPartitions && p < interval+1; p++ {
+			partitions = append(partitions, p)
+		}
+		for _, p := range partitions {
+			for _, lazy := range []bool{false, true} {
+				all = append(all, &Plan{
+					IntervalSize:  interval,
+					NumPartitions: p,
+					LazyBPTT:      lazy,
+					Cost:          RecursiveHSMCost(seqLen, interval, p, lazy),
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		m1, m2 := all[i].Cost.Memory(), all[j].Cost.Memory()
+		if m1 == m2 {
+			return all[i].Cost.Steps < all[j].Cost.Steps
+		}
+		return m1 < m2
+	})
+
+	var frontier []*Plan
+	for _, p := range all {
+		if len(frontier) == 0 || p.Cost.Steps < frontier[len(frontier)-1].Cost.Steps {
+			frontier = append(frontier, p)
+		}
+	}
+
+	for i := 0; i < len(frontier)/2; i++ {
+		j := len(frontier) - (i + 1)
+		frontier[i], frontier[j] = frontier[j], frontier[i]
+	}
+	return frontier
+}
+
+// Recommend finds the plan with the fewest steps that
+// stores no more than memory timesteps at once.
+// This is BPTT whenever BPTT fits in the budget.
+//
+// If no plan fits in the memory budget, nil is returned.
+func Recommend(seqLen, maxPartitions, memory int) *Plan {
+	return RecommendFrom(Plans(seqLen, maxPartitions), memory)
+}
+
+// RecommendFrom is like Recommend, but it chooses from
+// the result of Plans().
+// The result is one of the elements of plans.
+func RecommendFrom(plans []*Plan, memory int) *Plan {
+	for _, p := range plans {
+		if p.Cost.Memory() <= memory {
+			return p
+		}
+	}
+	return nil
+}
+
+// hsmSimulator mirrors the recursion in recHSMFrag.
+type hsmSimulator struct {
+	Partitions int
+	LazyBPTT   bool
+
+	// Cache maps (length, interval) pairs to costs.
+	Cache map[[2]int]Cost
+}
+
+// Cost computes the cost of a recHSMFrag.
+func (h *hsmSimulator) Cost(length, interval int) Cost {
+	key := [2]int{length, interval}
+	if c, ok := h.Cache[key]; ok {
+		return c
+	}
+
+	// The forward pass saves a state every interval steps.
+	res := Cost{
+		PeakStates: (length + interval - 1) / interval,
+		Steps:      length,
+	}
+	saved := res.PeakStates
+
+	for start := 0; start < length; start += interval {
+		end := essentials.MinInt(length, start+interval)
+		sub := h.subCost(end - start)
+		res.PeakStates = essentials.MaxInt(res.PeakStates, saved+sub.PeakStates)
+		res.PeakInputs = essentials.MaxInt(res.PeakInputs, sub.PeakInputs)
+		res.Steps += sub.Steps
+	}
+
+	h.Cache[key] = res
+	return res
+}
+
+// subCost computes the cost of a sub-fragment, as
+// created by recHSMFrag.subFragment.
+func (h *hsmSimulator) subCost(length int) Cost {
+	if length <= 1 || (length <= h.Partitions && !h.LazyBPTT) {
+		return BPTTCost(length)
+	}
+	interval := essentials.MaxInt(1, length/h.Partitions)
+	return h.Cost(length, interval)
+}
@@ -97,3 +97,88 @@ func (m *mutexGrad) Use(f func(g anydiff.Grad)) {
 	defer m.lock.Unlock()
 	f(m.grad)
 }
+
+// LocalGrad is a Grad which gives every concurrent call
+// to Use its own local gradient, so that calls to Use do
+// not block each other.
+//
+// The local gradients start out as zero and are added to
+// the wrapped gradient by Flush.
+// Thus, while f is running, no other call to Use will
+// see the same gradient, but the values in the gradient
+// are only a partial sum.
+// This is sufficient for functions which add to the
+// gradient, such as anydiff.Res.Propagate.
+//
+// LocalGrad is not lock-free.
+// Every call to Use briefly locks a mutex to borrow and
+// return a local gradient, although the mutex is not
+// held while f runs.
+// Each local gradient is a zeroed copy of the entire
+// wrapped gradient, and one is allocated whenever more
+// calls to Use overlap than ever before.
+// Thus, memory usage grows with the number of concurrent
+// calls times the size of the gradient, and Flush takes
+// time proportional to the same product.
+type LocalGrad struct {
+	grad anydiff.Grad
+
+	lock  sync.Mutex
+	free  []anydiff.Grad
+	local []anydiff.Grad
+}
+
+// NewLocalGrad creates a LocalGrad which wraps a raw
+// gradient.
+func NewLocalGrad(g anydiff.Grad) *LocalGrad {
+	return &LocalGrad{grad: g}
+}
+
+// Use calls f with a local gradient that no other call to
+// Use is using at the same time.
+func (l *LocalGrad) Use(f func(g anydiff.Grad)) {
+	g := l.acquire()
+	defer l.release(g)
+	f(g)
+}
+
+// Flush adds the local gradients to the wrapped gradient
+// and releases them.
+//
+// Flush should not be called while any calls to Use are
+// in progress.
+func (l *LocalGrad) Flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, g := range l.local {
+		for v, vec := range g {
+			if sum, ok := l.grad[v]; ok {
+				sum.Add(vec)
+			}
+		}
+	}
+	l.free = nil
+	l.local = nil
+}
+
+func (l *LocalGrad) acquire() anydiff.Grad {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.free) > 0 {
+		g := l.free[len(l.free)-1]
+		l.free = l.free[:len(l.free)-1]
+		return g
+	}
+	g := anydiff.Grad{}
+	for v, vec := range l.grad {
+		g[v] = vec.Creator().MakeVector(vec.Len())
+	}
+	l.local = append(l.local, g)
+	return g
+}
+
+func (l *LocalGrad) release(g anydiff.Grad) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.free = append(l.free, g)
+}
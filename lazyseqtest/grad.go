@@ -0,0 +1,125 @@
+package lazyseqtest
+
+import (
+	"math"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/internal/numeric"
+)
+
+// CheckGradients compares the gradients computed by a
+// Seq to gradients approximated with central differences.
+//
+// The makeSeq function should create a new Seq every time
+// it is called, reading the current values of the
+// variables.
+// The gradients are computed for the dot product between
+// the sequence and a fixed random upstream sequence.
+//
+// If vars is nil, every variable of the Seq is checked.
+//
+// Each variable component is moved by eps in either
+// direction, and a mismatch is reported if the gradient
+// differs from the approximation by more than tol.
+// At most one mismatch is reported per variable.
+func CheckGradients(t T, makeSeq func() lazyseq.Seq, vars []*anydiff.Var,
+	eps, tol float64) {
+	seq := makeSeq()
+	outs, ok := readAll(seq.Forward())
+	if !ok {
+		t.Errorf("Forward() channel was not closed")
+		return
+	}
+	if vars == nil {
+		varSet, ok := readVars(t, seq)
+		if !ok {
+			return
+		}
+		vars = varSet.Slice()
+	}
+
+	upstream := randomUpstream(outs)
+	grad, ok := propagateGrad(t, seq, upstream, vars)
+	if !ok {
+		return
+	}
+
+	objective := func() (float64, bool) {
+		outs, ok := readAll(makeSeq().Forward())
+		if !ok {
+			return 0, false
+		} else if len(outs) != len(upstream) {
+			return 0, false
+		}
+		var res float64
+		for i, batch := range outs {
+			up := numeric.Floats(upstream[i].Packed)
+			out := numeric.Floats(batch.Packed)
+			if len(up) != len(out) {
+				return 0, false
+			}
+			for j, x := range out {
+				res += x * up[j]
+			}
+		}
+		return res, true
+	}
+
+	for varIdx, v := range vars {
+		actual := numeric.Floats(grad[v])
+		for i, act := range actual {
+			plus, ok1 := offsetComponent(v, i, eps, objective)
+			minus, ok2 := offsetComponent(v, i, -eps, objective)
+			if !ok1 || !ok2 {
+				t.Errorf("output shape changed when variable %d was modified", varIdx)
+				return
+			}
+			expected := (plus - minus) / (2 * eps)
+			if math.Abs(expected-act) > tol {
+				t.Errorf("variable %d, component %d: expected gradient %g but got %g",
+					varIdx, i, expected, act)
+				break
+			}
+		}
+	}
+}
+
+// offsetComponent evaluates f while one component of a
+// variable is offset by delta.
+func offsetComponent(v *anydiff.Var, idx int, delta float64,
+	f func() (float64, bool)) (float64, bool) {
+	c := v.Vector.Creator()
+	orig := v.Vector.Copy()
+	data := numeric.Floats(orig)
+	data[idx] += delta
+	v.Vector.SetData(c.MakeNumericList(data))
+	defer v.Vector.Set(orig)
+	return f()
+}
+
+// propagateGrad back-propagates upstream through a Seq
+// whose outputs have already been read.
+// It returns false if Propagate() blocked.
+func propagateGrad(t T, seq lazyseq.Seq, upstream []*anyseq.Batch,
+	vars []*anydiff.Var) (anydiff.Grad, bool) {
+	grad := anydiff.NewGrad(vars...)
+	if !waitFor(propagate(seq, sendUpstream(upstream, nil), grad)) {
+		t.Errorf("Propagate() did not return")
+		return nil, false
+	}
+	return grad, true
+}
+
+// gradsEqual returns false if two gradients differ by
+// more than tol.
+func gradsEqual(g1, g2 anydiff.Grad, tol float64) bool {
+	for v, vec := range g1 {
+		other, ok := g2[v]
+		if !ok || !floatsClose(numeric.Floats(vec), numeric.Floats(other), tol) {
+			return false
+		}
+	}
+	return true
+}
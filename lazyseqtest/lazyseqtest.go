@@ -0,0 +1,191 @@
+// Package lazyseqtest provides tools for testing custom
+// lazyseq.Seq and lazyseq.Rereader implementations.
+//
+// CheckGradients compares back-propagation to finite
+// differences.
+// CheckSeq and CheckRereader verify that an
+// implementation follows the rules laid out in the
+// documentation for lazyseq.Seq and lazyseq.Rereader,
+// such as unblocking Vars() before reading upstream
+// batches.
+package lazyseqtest
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/internal/numeric"
+)
+
+// T is the subset of testing.TB used to report failures.
+type T interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Timeout is how long a check waits for a channel or a
+// blocking call before it reports a deadlock.
+var Timeout = time.Second * 10
+
+// readAll reads every batch from a channel.
+// It returns false if the channel was not closed before
+// the timeout.
+func readAll(ch <-chan *anyseq.Batch) ([]*anyseq.Batch, bool) {
+	var res []*anyseq.Batch
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case batch, ok := <-ch:
+			if !ok {
+				return res, true
+			}
+			res = append(res, batch)
+		case <-timeout:
+			return res, false
+		}
+	}
+}
+
+// waitFor waits for a channel to be closed.
+// It returns false if the timeout expired first.
+func waitFor(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(Timeout):
+		return false
+	}
+}
+
+// readVars reads the variables of a Seq whose Forward()
+// channel has already been exhausted.
+func readVars(t T, seq lazyseq.Seq) (anydiff.VarSet, bool) {
+	var res anydiff.VarSet
+	done := make(chan struct{})
+	go func() {
+		res = seq.Vars()
+		close(done)
+	}()
+	if !waitFor(done) {
+		t.Errorf("Vars() blocked after Forward() was read")
+		return nil, false
+	}
+	return res, true
+}
+
+// randomUpstream creates random upstream batches with the
+// same shapes as the outputs.
+// The same outputs always produce the same upstream.
+func randomUpstream(outs []*anyseq.Batch) []*anyseq.Batch {
+	gen := rand.New(rand.NewSource(1337))
+	res := make([]*anyseq.Batch, len(outs))
+	for i, batch := range outs {
+		c := batch.Packed.Creator()
+		data := make([]float64, batch.Packed.Len())
+		for j := range data {
+			data[j] = gen.NormFloat64()
+		}
+		res[i] = &anyseq.Batch{
+			Packed:  c.MakeVectorData(c.MakeNumericList(data)),
+			Present: batch.Present,
+		}
+	}
+	return res
+}
+
+// zeroUpstream creates upstream batches of zeros.
+func zeroUpstream(outs []*anyseq.Batch) []*anyseq.Batch {
+	res := make([]*anyseq.Batch, len(outs))
+	for i, batch := range outs {
+		res[i] = &anyseq.Batch{
+			Packed:  batch.Packed.Creator().MakeVector(batch.Packed.Len()),
+			Present: batch.Present,
+		}
+	}
+	return res
+}
+
+// sendUpstream sends copies of the upstream batches to a
+// channel, from last to first.
+// The result is closed once every batch has been sent.
+//
+// If ready is non-nil, nothing is sent until it is
+// closed.
+func sendUpstream(upstream []*anyseq.Batch, ready <-chan struct{}) <-chan *anyseq.Batch {
+	res := make(chan *anyseq.Batch)
+	go func() {
+		if ready != nil {
+			<-ready
+		}
+		for i := len(upstream) - 1; i >= 0; i-- {
+			res <- &anyseq.Batch{
+				Packed:  upstream[i].Packed.Copy(),
+				Present: upstream[i].Present,
+			}
+		}
+		close(res)
+	}()
+	return res
+}
+
+// propagate back-propagates through a Seq in the
+// background.
+// The result is closed once Propagate() returns.
+func propagate(seq lazyseq.Seq, upstream <-chan *anyseq.Batch,
+	g anydiff.Grad) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		seq.Propagate(upstream, lazyseq.NewGrad(g))
+		close(done)
+	}()
+	return done
+}
+
+// batchesEqual compares two lists of batches.
+// It returns a description of the first difference, or
+// an empty string if the batches are equal.
+func batchesEqual(actual, expected []*anyseq.Batch, tol float64) string {
+	if len(actual) != len(expected) {
+		return fmt.Sprintf("expected %d batches but got %d", len(expected),
+			len(actual))
+	}
+	for i, act := range actual {
+		exp := expected[i]
+		if !presentsEqual(act.Present, exp.Present) {
+			return fmt.Sprintf("batch %d: expected present map %v but got %v", i,
+				exp.Present, act.Present)
+		}
+		if !floatsClose(numeric.Floats(act.Packed), numeric.Floats(exp.Packed), tol) {
+			return fmt.Sprintf("batch %d: expected %v but got %v", i,
+				exp.Packed.Data(), act.Packed.Data())
+		}
+	}
+	return ""
+}
+
+func presentsEqual(p1, p2 []bool) bool {
+	if len(p1) != len(p2) {
+		return false
+	}
+	for i, x := range p1 {
+		if x != p2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func floatsClose(v1, v2 []float64, tol float64) bool {
+	if len(v1) != len(v2) {
+		return false
+	}
+	for i, x := range v1 {
+		if diff := x - v2[i]; diff > tol || diff < -tol {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package lazyseqtest
+
+import (
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/lazyseq"
+)
+
+// CheckSeq verifies that a Seq follows the rules in the
+// documentation for lazyseq.Seq.
+// In particular, it checks that:
+//
+//   - Forward() always returns the same channel, and
+//     that channel is closed.
+//   - Vars() unblocks once Forward() has been read.
+//   - Propagate() unblocks Vars() before it reads any
+//     upstream batches, even if Forward() is unread.
+//   - Propagate() returns once upstream is closed.
+//   - Propagate() can be called more than once, with
+//     the same results every time.
+//
+// The makeSeq function should create a new Seq every time
+// it is called.
+// Every Seq it creates should produce the same outputs.
+//
+// Deadlocks are reported after Timeout.
+func CheckSeq(t T, makeSeq func() lazyseq.Seq) {
+	outs, vars, ok := checkForward(t, makeSeq())
+	if !ok {
+		return
+	}
+	checkVarsUnblock(t, makeSeq(), outs, vars)
+	checkRepeatedPropagate(t, makeSeq())
+}
+
+// CheckRereader is like CheckSeq, but it also verifies
+// that a Rereader follows the rules in the documentation
+// for lazyseq.Rereader.
+// In particular, it checks that:
+//
+//   - Reread() produces the outputs in every range,
+//     including empty ranges, and closes the channel.
+//   - Propagate() unblocks Reread() before it reads
+//     any upstream batches.
+func CheckRereader(t T, makeRereader func() lazyseq.Rereader) {
+	CheckSeq(t, func() lazyseq.Seq {
+		return makeRereader()
+	})
+	checkRereadRanges(t, makeRereader())
+	checkRereadUnblock(t, makeRereader())
+}
+
+// checkForward reads the outputs and variables of a Seq
+// and then propagates through it.
+func checkForward(t T, seq lazyseq.Seq) ([]*anyseq.Batch, anydiff.VarSet, bool) {
+	if seq.Forward() != seq.Forward() {
+		t.Errorf("Forward() returned different channels")
+		return nil, nil, false
+	}
+	outs, ok := readAll(seq.Forward())
+	if !ok {
+		t.Errorf("Forward() channel was not closed")
+		return nil, nil, false
+	}
+	vars, ok := readVars(t, seq)
+	if !ok {
+		return nil, nil, false
+	}
+	if _, ok := propagateGrad(t, seq, zeroUpstream(outs), vars.Slice()); !ok {
+		return nil, nil, false
+	}
+	return outs, vars, true
+}
+
+func checkVarsUnblock(t T, seq lazyseq.Seq, outs []*anyseq.Batch, vars anydiff.VarSet) {
+	ready := make(chan struct{})
+	upstream := sendUpstream(zeroUpstream(outs), ready)
+	done := propagate(seq, upstream, anydiff.NewGrad(vars.Slice()...))
+
+	varsDone := make(chan struct{})
+	go func() {
+		seq.Vars()
+		close(varsDone)
+	}()
+	if !waitFor(varsDone) {
+		t.Errorf("Propagate() did not unblock Vars() before reading upstream")
+	}
+
+	close(ready)
+	if !waitFor(done) {
+		t.Errorf("Propagate() did not return")
+	}
+}
+
+func checkRepeatedPropagate(t T, seq lazyseq.Seq) {
+	outs, ok := readAll(seq.Forward())
+	if !ok {
+		t.Errorf("Forward() channel was not closed")
+		return
+	}
+	vars, ok := readVars(t, seq)
+	if !ok {
+		return
+	}
+	upstream := randomUpstream(outs)
+	grad1, ok := propagateGrad(t, seq, upstream, vars.Slice())
+	if !ok {
+		return
+	}
+	grad2, ok := propagateGrad(t, seq, upstream, vars.Slice())
+	if !ok {
+		return
+	}
+	if !gradsEqual(grad1, grad2, 1e-4) {
+		t.Errorf("repeated Propagate() produced different gradients")
+	}
+}
+
+func checkRereadRanges(t T, r lazyseq.Rereader) {
+	outs, ok := readAll(r.Forward())
+	if !ok {
+		t.Errorf("Forward() channel was not closed")
+		return
+	}
+	defer func() {
+		vars, ok := readVars(t, r)
+		if ok {
+			propagateGrad(t, r, zeroUpstream(outs), vars.Slice())
+		}
+	}()
+	for start := 0; start <= len(outs); start++ {
+		for end := start; end <= len(outs); end++ {
+			actual, ok := readAll(r.Reread(start, end))
+			if !ok {
+				t.Errorf("Reread(%d, %d) channel was not closed", start, end)
+				return
+			}
+			if msg := batchesEqual(actual, outs[start:end], 1e-4); msg != "" {
+				t.Errorf("Reread(%d, %d): %s", start, end, msg)
+				return
+			}
+		}
+	}
+}
+
+func checkRereadUnblock(t T, r lazyseq.Rereader) {
+	outs, ok := readAll(r.Forward())
+	if !ok {
+		t.Errorf("Forward() channel was not closed")
+		return
+	}
+	vars, ok := readVars(t, r)
+	if !ok {
+		return
+	}
+
+	ready := make(chan struct{})
+	upstream := sendUpstream(zeroUpstream(outs), ready)
+	done := propagate(r, upstream, anydiff.NewGrad(vars.Slice()...))
+
+	if _, ok := readAll(r.Reread(0, len(outs))); !ok {
+		t.Errorf("Propagate() did not unblock Reread() before reading upstream")
+	}
+
+	close(ready)
+	if !waitFor(done) {
+		t.Errorf("Propagate() did not return")
+	}
+}
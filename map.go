@@ -4,6 +4,7 @@ import (
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anydiff/anyseq"
 	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
 )
 
 // Map applies the function f to the timesteps of seq.
@@ -16,14 +17,87 @@ func Map(seq Rereader, f func(v anydiff.Res, n int) anydiff.Res) Rereader {
 	}, seq)
 }
 
+// MapOptions controls which intermediate results of a
+// map are stored to avoid calling the mapped function
+// again.
+//
+// The zero value stores nothing, so the function is
+// called again for every Reread and during Propagate.
+type MapOptions struct {
+	// StoreOutputs, if true, stores the output of every
+	// timestep in memory so that Reread does not have to
+	// recompute them.
+	StoreOutputs bool
+
+	// Tape and TapeWriter, if non-nil, are used to store
+	// the outputs instead of memory.
+	// TapeWriter is closed once every output has been
+	// written.
+	//
+	// For an example of creating a Tape with a
+	// corresponding writer channel, see ReferenceTape.
+	Tape       Tape
+	TapeWriter chan<- *anyseq.Batch
+
+	// KeepGraph, if true, keeps the anydiff.Res produced
+	// at every timestep, so that Propagate does not have
+	// to reread the inputs or recompute the outputs.
+	// The outputs of the graph are also used by Reread.
+	//
+	// At most one of StoreOutputs, Tape, and KeepGraph
+	// may be set.
+	KeepGraph bool
+
+	// Workers is the maximum number of timesteps for which
+	// the mapped function may be evaluated (or propagated
+	// through) concurrently.
+	// Outputs are still produced in order.
+	//
+	// If this is greater than 1, the mapped function must
+	// be safe to call from multiple goroutines at once.
+	// A value of 0 is treated like 1.
+	Workers int
+}
+
+// validate panics if the options conflict.
+func (m *MapOptions) validate() {
+	if (m.Tape == nil) != (m.TapeWriter == nil) {
+		panic("MapOptions: Tape and TapeWriter must be set together")
+	}
+	var numStores int
+	for _, set := range []bool{m.StoreOutputs, m.Tape != nil, m.KeepGraph} {
+		if set {
+			numStores++
+		}
+	}
+	if numStores > 1 {
+		panic("MapOptions: at most one of StoreOutputs, Tape, and KeepGraph may be set")
+	}
+	if m.Workers < 0 {
+		panic("MapOptions: negative Workers")
+	}
+}
+
 type mapNRes struct {
 	Ins  []Rereader
-	F    func(n int, v ...anydiff.Res) anydiff.Res
+	F    func(t int, present []bool, v ...anydiff.Res) anydiff.Res
+	Opts MapOptions
 	Outs <-chan *anyseq.Batch
 
-	Done <-chan struct{}
-	Len  int
-	V    anydiff.VarSet
+	// Fields become valid after Done is closed.
+	Done   <-chan struct{}
+	Len    int
+	V      anydiff.VarSet
+	Stored []*anyseq.Batch
+	Graphs []*mapGraph
+}
+
+// mapGraph stores the computation graph for a single
+// timestep of a map.
+type mapGraph struct {
+	Present []bool
+	Pools   []*anydiff.Var
+	Out     anydiff.Res
 }
 
 // MapN applies a function to every timestep in a batch
@@ -42,14 +116,57 @@ type mapNRes struct {
 //
 // It is invalid to map over 0 sequences.
 func MapN(f func(n int, v ...anydiff.Res) anydiff.Res, s ...Rereader) Rereader {
+	return MapNIndexed(func(t int, present []bool, v ...anydiff.Res) anydiff.Res {
+		var n int
+		for _, p := range present {
+			if p {
+				n++
+			}
+		}
+		return f(n, v...)
+	}, s...)
+}
+
+// MapNIndexed is like MapN, but f is given the index of
+// the timestep and the present map rather than the batch
+// size.
+//
+// The timestep index is absolute, even when f is called
+// to recompute a timestep for Reread or Propagate.
+func MapNIndexed(f func(t int, present []bool, v ...anydiff.Res) anydiff.Res,
+	s ...Rereader) Rereader {
+	return MapNWith(MapOptions{}, f, s...)
+}
+
+// MapWith is like Map, but with options to control what
+// is stored rather than recomputed.
+func MapWith(opts MapOptions, seq Rereader,
+	f func(v anydiff.Res, n int) anydiff.Res) Rereader {
+	return MapNWith(opts, func(t int, present []bool, v ...anydiff.Res) anydiff.Res {
+		var n int
+		for _, p := range present {
+			if p {
+				n++
+			}
+		}
+		return f(v[0], n)
+	}, seq)
+}
+
+// MapNWith is like MapNIndexed, but with options to
+// control what is stored rather than recomputed.
+func MapNWith(opts MapOptions, f func(t int, present []bool, v ...anydiff.Res) anydiff.Res,
+	s ...Rereader) Rereader {
 	if len(s) == 0 {
 		panic("need at least one sequence")
 	}
+	opts.validate()
 	out := make(chan *anyseq.Batch, 1)
 	done := make(chan struct{})
 	res := &mapNRes{
 		Ins:  s,
 		F:    f,
+		Opts: opts,
 		Outs: out,
 		Done: done,
 		V:    anydiff.VarSet{},
@@ -81,23 +198,42 @@ func (m *mapNRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
 	}
 	downstream, wg := propagateMany(seqs, grad)
 
-	for idx := m.Len - 1; idx >= 0; idx-- {
-		inChans := make([]<-chan *anyseq.Batch, len(m.Ins))
-		for i, in := range m.Ins {
-			inChans[i] = in.Reread(idx, idx+1)
-		}
-		u, ok := <-upstream
-		if !ok {
-			panic("not enough upstream batches")
-		}
-		down := m.propThroughF(inChans, u, grad)
-		for i, downBatch := range down {
+	sendDown := func(res []*anyseq.Batch) {
+		for i, downBatch := range res {
 			if downstream[i] != nil {
 				downstream[i] <- downBatch
 			}
 		}
 	}
 
+	if m.Opts.Workers <= 1 {
+		for idx := m.Len - 1; idx >= 0; idx-- {
+			u, ok := <-upstream
+			if !ok {
+				panic("not enough upstream batches")
+			}
+			sendDown(m.propagateStep(idx, u, grad)())
+		}
+	} else {
+		jobs := make(chan func() interface{})
+		go func() {
+			defer close(jobs)
+			for idx := m.Len - 1; idx >= 0; idx-- {
+				u, ok := <-upstream
+				if !ok {
+					panic("not enough upstream batches")
+				}
+				step := m.propagateStep(idx, u, grad)
+				jobs <- func() interface{} {
+					return step()
+				}
+			}
+		}()
+		runOrdered(m.Opts.Workers, jobs, func(res interface{}) {
+			sendDown(res.([]*anyseq.Batch))
+		})
+	}
+
 	if _, ok := <-upstream; ok {
 		panic("too many upstream batches")
 	}
@@ -112,50 +248,169 @@ func (m *mapNRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
 }
 
 func (m *mapNRes) Reread(start, end int) <-chan *anyseq.Batch {
+	if m.Opts.KeepGraph || m.Opts.StoreOutputs || m.Opts.Tape != nil {
+		return m.rereadStored(start, end)
+	}
 	res := make(chan *anyseq.Batch, 1)
 	chans := make([]<-chan *anyseq.Batch, len(m.Ins))
 	for i, in := range m.Ins {
 		chans[i] = in.Reread(start, end)
 	}
 	go func() {
-		m.readAndApply(chans, res)
+		m.readAndApply(start, chans, res, false)
 		close(res)
 	}()
 	return res
 }
 
-func (m *mapNRes) readAndApply(chans []<-chan *anyseq.Batch,
-	out chan<- *anyseq.Batch) (int, anydiff.VarSet) {
+// readAndApply calls m.F on the inputs from chans and
+// sends the outputs to out.
+//
+// If record is true, the results are stored according to
+// m.Opts.
+func (m *mapNRes) readAndApply(start int, chans []<-chan *anyseq.Batch,
+	out chan<- *anyseq.Batch, record bool) (int, anydiff.VarSet) {
 	vars := anydiff.VarSet{}
 	var count int
-	for {
-		var ins []anydiff.Res
-		var present []bool
-		var numPres int
-		for _, ch := range chans {
-			if in, ok := <-ch; ok {
-				if len(ins) > 0 {
-					if !presentMapsEqual(present, in.Present) {
-						panic("present map mismatch")
-					}
+	handle := func(step *mapStep) {
+		count++
+		outBatch := &anyseq.Batch{Packed: step.Res.Output(), Present: step.Present}
+		if record {
+			vars = anydiff.MergeVarSets(vars, m.record(step.Present, step.Ins,
+				step.Res, outBatch))
+		} else {
+			vars = anydiff.MergeVarSets(vars, step.Res.Vars())
+		}
+		out <- outBatch
+	}
+
+	if m.Opts.Workers <= 1 {
+		for t := start; true; t++ {
+			step := m.readStep(t, chans, record)
+			if step == nil {
+				break
+			}
+			step.Res = m.F(t, step.Present, step.Ins...)
+			handle(step)
+		}
+		return count, vars
+	}
+
+	jobs := make(chan func() interface{})
+	go func() {
+		defer close(jobs)
+		for t := start; true; t++ {
+			step := m.readStep(t, chans, record)
+			if step == nil {
+				return
+			}
+			t := t
+			jobs <- func() interface{} {
+				step.Res = m.F(t, step.Present, step.Ins...)
+				// Compute the output before it is needed
+				// so that the work happens in parallel.
+				step.Res.Output()
+				return step
+			}
+		}
+	}()
+	runOrdered(m.Opts.Workers, jobs, func(result interface{}) {
+		handle(result.(*mapStep))
+	})
+	return count, vars
+}
+
+// mapStep stores the inputs and output of m.F for a
+// single timestep.
+type mapStep struct {
+	Present []bool
+	Ins     []anydiff.Res
+	Res     anydiff.Res
+}
+
+// readStep reads the inputs for the next timestep.
+// It returns nil if there are no more timesteps.
+func (m *mapNRes) readStep(t int, chans []<-chan *anyseq.Batch, record bool) *mapStep {
+	step := &mapStep{}
+	for _, ch := range chans {
+		if in, ok := <-ch; ok {
+			if len(step.Ins) > 0 {
+				if !presentMapsEqual(step.Present, in.Present) {
+					panic("present map mismatch")
 				}
-				numPres = in.NumPresent()
-				present = in.Present
-				ins = append(ins, anydiff.NewConst(in.Packed))
+			}
+			step.Present = in.Present
+			if record && m.Opts.KeepGraph {
+				step.Ins = append(step.Ins, anydiff.NewVar(in.Packed))
+			} else {
+				step.Ins = append(step.Ins, anydiff.NewConst(in.Packed))
 			}
 		}
-		if len(ins) == 0 {
-			break
-		} else if len(ins) != len(chans) {
-			panic("sequence length mismatch")
+	}
+	if len(step.Ins) == 0 {
+		return nil
+	} else if len(step.Ins) != len(chans) {
+		panic("sequence length mismatch")
+	}
+	return step
+}
+
+// record stores the results of a timestep according to
+// m.Opts and returns the variables that the output of
+// the timestep depends on.
+func (m *mapNRes) record(present []bool, ins []anydiff.Res, res anydiff.Res,
+	outBatch *anyseq.Batch) anydiff.VarSet {
+	if m.Opts.StoreOutputs {
+		m.Stored = append(m.Stored, outBatch)
+	}
+	if m.Opts.TapeWriter != nil {
+		m.Opts.TapeWriter <- outBatch
+	}
+	if !m.Opts.KeepGraph {
+		return res.Vars()
+	}
+
+	graph := &mapGraph{Present: present, Out: res}
+	isPool := map[*anydiff.Var]bool{}
+	for _, in := range ins {
+		pool := in.(*anydiff.Var)
+		graph.Pools = append(graph.Pools, pool)
+		isPool[pool] = true
+	}
+	m.Graphs = append(m.Graphs, graph)
+
+	var vars []*anydiff.Var
+	for v := range res.Vars() {
+		if !isPool[v] {
+			vars = append(vars, v)
 		}
-		count++
-		res := m.F(numPres, ins...)
-		vars = anydiff.MergeVarSets(vars, res.Vars())
-		outVec := res.Output()
-		out <- &anyseq.Batch{Packed: outVec, Present: present}
 	}
-	return count, vars
+	return anydiff.NewVarSet(vars...)
+}
+
+// rereadStored produces outputs which were stored during
+// the forward pass.
+func (m *mapNRes) rereadStored(start, end int) <-chan *anyseq.Batch {
+	<-m.Done
+	if start < 0 || end < start || end > m.Len {
+		panic("slice bounds out of range")
+	}
+	if m.Opts.Tape != nil {
+		return m.Opts.Tape.ReadTape(start, end)
+	}
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		for t := start; t < end; t++ {
+			if m.Opts.KeepGraph {
+				graph := m.Graphs[t]
+				res <- &anyseq.Batch{Present: graph.Present, Packed: graph.Out.Output()}
+			} else {
+				res <- m.Stored[t]
+			}
+		}
+		close(res)
+	}()
+	return res
 }
 
 func (m *mapNRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
@@ -163,37 +418,62 @@ func (m *mapNRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
 	for i, x := range m.Ins {
 		inChans[i] = x.Forward()
 	}
-	m.Len, m.V = m.readAndApply(inChans, out)
+	m.Len, m.V = m.readAndApply(0, inChans, out, true)
 	for _, in := range m.Ins {
 		m.V = anydiff.MergeVarSets(m.V, in.Vars())
 	}
+	if m.Opts.TapeWriter != nil {
+		close(m.Opts.TapeWriter)
+	}
 	close(done)
 	close(out)
 }
 
+// propagateStep starts rereading the inputs for
+// timestep idx, if necessary, and returns a function
+// which propagates upstream through that timestep.
+func (m *mapNRes) propagateStep(idx int, upstream *anyseq.Batch,
+	grad Grad) func() []*anyseq.Batch {
+	if m.Opts.KeepGraph {
+		return func() []*anyseq.Batch {
+			return m.propThroughGraph(m.Graphs[idx], upstream, grad)
+		}
+	}
+	inChans := make([]<-chan *anyseq.Batch, len(m.Ins))
+	for i, in := range m.Ins {
+		inChans[i] = in.Reread(idx, idx+1)
+	}
+	return func() []*anyseq.Batch {
+		return m.propThroughF(idx, inChans, upstream, grad)
+	}
+}
+
 // propThroughF calls m.F with the inputs, propagates
 // through the result, and returns the downstream
 // gradient.
-func (m *mapNRes) propThroughF(ins []<-chan *anyseq.Batch, upstream *anyseq.Batch,
-	grad Grad) []*anyseq.Batch {
-	var batchSize int
+func (m *mapNRes) propThroughF(t int, ins []<-chan *anyseq.Batch,
+	upstream *anyseq.Batch, grad Grad) []*anyseq.Batch {
 	var present []bool
 	inReses := make([]anydiff.Res, len(m.Ins))
 	inPools := make([]*anydiff.Var, len(m.Ins))
 	for i, ch := range ins {
 		batch := <-ch
 		present = batch.Present
-		batchSize = batch.NumPresent()
 		inPools[i] = anydiff.NewVar(batch.Packed)
 		inReses[i] = inPools[i]
 	}
 
+	if m.Opts.Workers > 1 {
+		out := m.F(t, present, inReses...)
+		return propagateLocal(out, inPools, present, upstream, grad)
+	}
+
 	var downstream []*anyseq.Batch
 	grad.Use(func(g anydiff.Grad) {
 		for _, pool := range inPools {
 			g[pool] = pool.Vector.Creator().MakeVector(pool.Vector.Len())
 		}
-		out := m.F(batchSize, inReses...)
+		out := m.F(t, present, inReses...)
 		out.Propagate(upstream.Packed, g)
 		for _, pool := range inPools {
 			downstream = append(downstream, &anyseq.Batch{
@@ -207,6 +487,99 @@ func (m *mapNRes) propThroughF(ins []<-chan *anyseq.Batch, upstream *anyseq.Batc
 	return downstream
 }
 
+// propThroughGraph propagates through a stored graph and
+// returns the downstream gradient.
+func (m *mapNRes) propThroughGraph(graph *mapGraph, upstream *anyseq.Batch,
+	grad Grad) []*anyseq.Batch {
+	if m.Opts.Workers > 1 {
+		return propagateLocal(graph.Out, graph.Pools, graph.Present, upstream, grad)
+	}
+
+	var downstream []*anyseq.Batch
+	grad.Use(func(g anydiff.Grad) {
+		for _, pool := range graph.Pools {
+			g[pool] = pool.Vector.Creator().MakeVector(pool.Vector.Len())
+		}
+		graph.Out.Propagate(upstream.Packed, g)
+		for _, pool := range graph.Pools {
+			downstream = append(downstream, &anyseq.Batch{
+				Packed:  g[pool],
+				Present: graph.Present,
+			})
+			delete(g, pool)
+		}
+	})
+	return downstream
+}
+
+// propagateLocal propagates through out using a local
+// gradient, so that the propagation can run concurrently
+// with other uses of grad.
+// The local gradient is then added to grad.
+//
+// It returns the gradients for each of the pools.
+func propagateLocal(out anydiff.Res, pools []*anydiff.Var, present []bool,
+	upstream *anyseq.Batch, grad Grad) []*anyseq.Batch {
+	local := anydiff.Grad{}
+	outVars := out.Vars()
+	grad.Use(func(g anydiff.Grad) {
+		for v, vec := range g {
+			if outVars.Has(v) {
+				local[v] = vec.Creator().MakeVector(vec.Len())
+			}
+		}
+	})
+	for _, pool := range pools {
+		local[pool] = pool.Vector.Creator().MakeVector(pool.Vector.Len())
+	}
+
+	out.Propagate(upstream.Packed, local)
+
+	var downstream []*anyseq.Batch
+	for _, pool := range pools {
+		downstream = append(downstream, &anyseq.Batch{
+			Packed:  local[pool],
+			Present: present,
+		})
+		delete(local, pool)
+	}
+	if len(local) > 0 {
+		grad.Use(func(g anydiff.Grad) {
+			for v, vec := range local {
+				g[v].Add(vec)
+			}
+		})
+	}
+	return downstream
+}
+
+// runOrdered calls the functions from jobs on up to
+// workers goroutines at once and passes their results to
+// handle in the order that the jobs were received.
+//
+// This is only worth its overhead when workers > 1.
+func runOrdered(workers int, jobs <-chan func() interface{},
+	handle func(interface{})) {
+	workers = essentials.MaxInt(1, workers)
+	results := make(chan chan interface{}, workers)
+	sem := make(chan struct{}, workers)
+	go func() {
+		for job := range jobs {
+			sem <- struct{}{}
+			result := make(chan interface{}, 1)
+			results <- result
+			go func(job func() interface{}) {
+				result <- job()
+				<-sem
+			}(job)
+		}
+		close(results)
+	}()
+	for result := range results {
+		handle(<-result)
+	}
+}
+
 func presentMapsEqual(p1, p2 []bool) bool {
 	if len(p1) != len(p2) {
 		return false
@@ -0,0 +1,197 @@
+package lazyseq
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+// An EventKind is a type of event reported to an
+// Observer.
+type EventKind int
+
+const (
+	// StepEvent is reported when an RNN block is applied
+	// to a timestep, including during re-computation.
+	StepEvent EventKind = iota
+
+	// SaveStateEvent is reported when a hidden state is
+	// stored for later use.
+	SaveStateEvent
+
+	// FreeStateEvent is reported when a stored hidden
+	// state is no longer referenced.
+	FreeStateEvent
+
+	// RereadEvent is reported when a Rereader is asked to
+	// re-produce some of its outputs.
+	// The time is the start of the requested range.
+	RereadEvent
+
+	// BatchEvent is reported when a batch is sent through
+	// a Forward() or Reread() channel.
+	BatchEvent
+)
+
+// An Observer is notified of events while sequences are
+// being evaluated or back-propagated.
+//
+// Observers may be called from multiple Goroutines at
+// once, so they must be thread-safe.
+type Observer interface {
+	// Observe is called for each event.
+	// The time is the timestep at which the event
+	// occurred.
+	Observe(kind EventKind, time int)
+}
+
+// A CountObserver is an Observer which counts events.
+//
+// The zero value is an empty CountObserver.
+type CountObserver struct {
+	lock   sync.Mutex
+	counts map[EventKind]map[int]int
+}
+
+// NewCountObserver creates an empty CountObserver.
+func NewCountObserver() *CountObserver {
+	return &CountObserver{counts: map[EventKind]map[int]int{}}
+}
+
+// Observe records the event.
+func (c *CountObserver) Observe(kind EventKind, time int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts == nil {
+		c.counts = map[EventKind]map[int]int{}
+	}
+	if c.counts[kind] == nil {
+		c.counts[kind] = map[int]int{}
+	}
+	c.counts[kind][time]++
+}
+
+// Count returns the total number of events of the given
+// kind.
+func (c *CountObserver) Count(kind EventKind) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var res int
+	for _, count := range c.counts[kind] {
+		res += count
+	}
+	return res
+}
+
+// CountAt returns the number of events of the given kind
+// which occurred at the given timestep.
+func (c *CountObserver) CountAt(kind EventKind, time int) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.counts[kind][time]
+}
+
+// A PeakObserver is an Observer which tracks how many
+// hidden states are stored at once.
+type PeakObserver struct {
+	lock sync.Mutex
+	live int
+	peak int
+}
+
+// Observe records the event.
+func (p *PeakObserver) Observe(kind EventKind, time int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch kind {
+	case SaveStateEvent:
+		p.live++
+		if p.live > p.peak {
+			p.peak = p.live
+		}
+	case FreeStateEvent:
+		p.live--
+	}
+}
+
+// Live returns the number of states which are currently
+// stored.
+func (p *PeakObserver) Live() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.live
+}
+
+// Peak returns the maximum number of states which have
+// been stored at once.
+func (p *PeakObserver) Peak() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.peak
+}
+
+// MultiObserver combines Observers into one Observer.
+type MultiObserver []Observer
+
+// Observe forwards the event to every Observer.
+func (m MultiObserver) Observe(kind EventKind, time int) {
+	for _, o := range m {
+		o.Observe(kind, time)
+	}
+}
+
+type observedRereader struct {
+	Rereader
+	Observer Observer
+	Out      <-chan *anyseq.Batch
+}
+
+// Observe wraps a Rereader so that an Observer is told
+// about every Reread() call and every batch that the
+// Rereader produces.
+func Observe(r Rereader, o Observer) Rereader {
+	return &observedRereader{
+		Rereader: r,
+		Observer: o,
+		Out:      observeBatches(r.Forward(), o, 0),
+	}
+}
+
+func (o *observedRereader) Creator() anyvec.Creator {
+	return o.Rereader.Creator()
+}
+
+func (o *observedRereader) Forward() <-chan *anyseq.Batch {
+	return o.Out
+}
+
+func (o *observedRereader) Vars() anydiff.VarSet {
+	return o.Rereader.Vars()
+}
+
+func (o *observedRereader) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range o.Forward() {
+	}
+	o.Rereader.Propagate(upstream, grad)
+}
+
+func (o *observedRereader) Reread(start, end int) <-chan *anyseq.Batch {
+	o.Observer.Observe(RereadEvent, start)
+	return observeBatches(o.Rereader.Reread(start, end), o.Observer, start)
+}
+
+func observeBatches(in <-chan *anyseq.Batch, o Observer, start int) <-chan *anyseq.Batch {
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		defer close(res)
+		t := start
+		for batch := range in {
+			o.Observe(BatchEvent, t)
+			res <- batch
+			t++
+		}
+	}()
+	return res
+}
@@ -112,25 +112,7 @@ func (p *packSeqRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
 // batches for each input.
 // If an input is not present yet, its batch is nil.
 func (p *packSeqRes) splitUpstream(upBatch *anyseq.Batch) []*anyseq.Batch {
-	vecSize := upBatch.Packed.Len() / upBatch.NumPresent()
-	res := make([]*anyseq.Batch, len(p.Ins))
-
-	var laneOffset int
-	var vecOffset int
-	for inIdx, numLanes := range p.LanesPerSeq {
-		subBatch := &anyseq.Batch{
-			Present: upBatch.Present[laneOffset : laneOffset+numLanes],
-		}
-		if subBatch.NumPresent() > 0 {
-			subBatch.Packed = upBatch.Packed.Slice(vecOffset*vecSize,
-				(vecOffset+subBatch.NumPresent())*vecSize)
-			res[inIdx] = subBatch
-			vecOffset += subBatch.NumPresent()
-		}
-		laneOffset += numLanes
-	}
-
-	return res
+	return splitLanes(upBatch, p.LanesPerSeq)
 }
 
 type packRereaderRes struct {
@@ -298,6 +280,33 @@ func streamAndJoin(c anyvec.Creator, sources []<-chan *anyseq.Batch,
 	}
 }
 
+// splitLanes splits a batch into sub-batches, where each
+// sub-batch contains a contiguous group of lanes.
+// The number of lanes in each group is given by
+// lanesPerSeq.
+// If a group has no present lanes, its batch is nil.
+func splitLanes(batch *anyseq.Batch, lanesPerSeq []int) []*anyseq.Batch {
+	vecSize := batch.Packed.Len() / batch.NumPresent()
+	res := make([]*anyseq.Batch, len(lanesPerSeq))
+
+	var laneOffset int
+	var vecOffset int
+	for i, numLanes := range lanesPerSeq {
+		subBatch := &anyseq.Batch{
+			Present: batch.Present[laneOffset : laneOffset+numLanes],
+		}
+		if subBatch.NumPresent() > 0 {
+			subBatch.Packed = batch.Packed.Slice(vecOffset*vecSize,
+				(vecOffset+subBatch.NumPresent())*vecSize)
+			res[i] = subBatch
+			vecOffset += subBatch.NumPresent()
+		}
+		laneOffset += numLanes
+	}
+
+	return res
+}
+
 // fillerBatch creates a placeholder batch that signifies
 // that a sequence batch has ended.
 func fillerBatch(c anyvec.Creator, lanes int) *anyseq.Batch {
@@ -0,0 +1,137 @@
+package lazyseq
+
+import (
+	"sort"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+type permuteRes struct {
+	In   Rereader
+	Perm []int
+	Inv  []int
+	Out  <-chan *anyseq.Batch
+}
+
+// PermuteLanes reorders the sequences in r, such that
+// sequence i of the result is sequence perm[i] of r.
+//
+// The perm slice must be a permutation of the lane
+// indices of r.
+//
+// Since every sequence is kept intact, each lane of the
+// result is present for a contiguous run of timesteps
+// starting at the first timestep, just like the lanes
+// of r.
+func PermuteLanes(r Rereader, perm []int) Rereader {
+	inv := make([]int, len(perm))
+	for i := range inv {
+		inv[i] = -1
+	}
+	for i, src := range perm {
+		if src < 0 || src >= len(perm) || inv[src] != -1 {
+			panic("invalid permutation")
+		}
+		inv[src] = i
+	}
+	res := &permuteRes{
+		In:   r,
+		Perm: perm,
+		Inv:  inv,
+	}
+	res.Out = res.permuteAll(r.Forward(), perm)
+	return res
+}
+
+func (p *permuteRes) Creator() anyvec.Creator {
+	return p.In.Creator()
+}
+
+func (p *permuteRes) Forward() <-chan *anyseq.Batch {
+	return p.Out
+}
+
+func (p *permuteRes) Vars() anydiff.VarSet {
+	return p.In.Vars()
+}
+
+func (p *permuteRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range p.Forward() {
+	}
+
+	p.In.Propagate(p.permuteAll(upstream, p.Inv), grad)
+}
+
+func (p *permuteRes) Reread(start, end int) <-chan *anyseq.Batch {
+	return p.permuteAll(p.In.Reread(start, end), p.Perm)
+}
+
+func (p *permuteRes) permuteAll(in <-chan *anyseq.Batch,
+	perm []int) <-chan *anyseq.Batch {
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range in {
+			res <- permuteBatch(p.Creator(), batch, perm)
+		}
+		close(res)
+	}()
+	return res
+}
+
+// LengthDescendingPerm computes a permutation which sorts
+// the sequences in a Tape from longest to shortest.
+//
+// Sequences of equal length keep their original order.
+// The result is suitable for PermuteLanes.
+//
+// This reads the entire tape, so it blocks until the tape
+// has been closed.
+func LengthDescendingPerm(t Tape) []int {
+	var lens []int
+	for batch := range t.ReadTape(0, -1) {
+		if lens == nil {
+			lens = make([]int, len(batch.Present))
+		}
+		for lane, pres := range batch.Present {
+			if pres {
+				lens[lane]++
+			}
+		}
+	}
+	perm := make([]int, len(lens))
+	for i := range perm {
+		perm[i] = i
+	}
+	sort.SliceStable(perm, func(i, j int) bool {
+		return lens[perm[i]] > lens[perm[j]]
+	})
+	return perm
+}
+
+// permuteBatch reorders the sequences in a batch, such
+// that sequence i of the result is sequence perm[i] of
+// the batch.
+func permuteBatch(c anyvec.Creator, batch *anyseq.Batch, perm []int) *anyseq.Batch {
+	if len(perm) != len(batch.Present) {
+		panic("permutation size does not match lane count")
+	}
+	rows := make([]anyvec.Vector, len(perm))
+	vecSize := batch.Packed.Len() / batch.NumPresent()
+	var rowIdx int
+	for lane, pres := range batch.Present {
+		if pres {
+			rows[lane] = batch.Packed.Slice(rowIdx*vecSize, (rowIdx+1)*vecSize)
+			rowIdx++
+		}
+	}
+	res := &anyseq.Batch{Present: make([]bool, len(perm))}
+	permuted := make([]anyvec.Vector, len(perm))
+	for i, src := range perm {
+		res.Present[i] = batch.Present[src]
+		permuted[i] = rows[src]
+	}
+	res.Packed = concatSparse(c, permuted)
+	return res
+}
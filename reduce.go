@@ -1,6 +1,9 @@
 package lazyseq
 
 import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anydiff/anyseq"
 	"github.com/unixpickle/anyvec"
 )
@@ -25,27 +28,164 @@ func (r *reducedTape) ReadTape(start, end int) <-chan *anyseq.Batch {
 	go func() {
 		defer close(res)
 		for in := range r.In.ReadTape(start, end) {
-			subset := append([]bool{}, in.Present...)
-			changed := false
-			numPresent := 0
-			for i, mask := range r.Present {
-				if subset[i] {
-					if !mask {
-						changed = true
-						subset[i] = false
-					} else {
-						numPresent++
-					}
-				}
-			}
-			if numPresent == 0 {
+			reduced := reduceBatch(in, r.Present)
+			if reduced == nil {
 				break
-			} else if changed {
-				res <- in.Reduce(subset)
-			} else {
-				res <- in
+			}
+			res <- reduced
+		}
+	}()
+	return res
+}
+
+type reduceSeqRes struct {
+	In      Seq
+	Present []bool
+	Out     <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done       <-chan struct{}
+	Len        int
+	Presents   [][]bool
+	PackedLens []int
+}
+
+// ReduceSeq produces a Seq without the sequences at
+// indices where present is false.
+//
+// If none of the remaining sequences are present at a
+// timestep, the result ends before that timestep.
+//
+// During back-propagation, the removed sequences receive
+// zero gradients.
+func ReduceSeq(seq Seq, present []bool) Seq {
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &reduceSeqRes{
+		In:      seq,
+		Present: present,
+		Out:     outChan,
+		Done:    doneChan,
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (r *reduceSeqRes) Creator() anyvec.Creator {
+	return r.In.Creator()
+}
+
+func (r *reduceSeqRes) Forward() <-chan *anyseq.Batch {
+	return r.Out
+}
+
+func (r *reduceSeqRes) Vars() anydiff.VarSet {
+	return r.In.Vars()
+}
+
+func (r *reduceSeqRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range r.Forward() {
+	}
+
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		r.In.Propagate(downstream, grad)
+		wg.Done()
+	}()
+
+	for t := len(r.Presents) - 1; t >= 0; t-- {
+		if t < r.Len {
+			u, ok := <-upstream
+			if !ok {
+				panic("not enough upstream batches")
+			}
+			downstream <- u.Expand(r.Presents[t])
+		} else {
+			downstream <- &anyseq.Batch{
+				Present: r.Presents[t],
+				Packed:  r.In.Creator().MakeVector(r.PackedLens[t]),
 			}
 		}
+	}
+
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+func (r *reduceSeqRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	ended := false
+	for batch := range r.In.Forward() {
+		r.Presents = append(r.Presents, batch.Present)
+		r.PackedLens = append(r.PackedLens, batch.Packed.Len())
+		if ended {
+			continue
+		}
+		if reduced := reduceBatch(batch, r.Present); reduced != nil {
+			r.Len++
+			out <- reduced
+		} else {
+			ended = true
+		}
+	}
+	close(done)
+	close(out)
+}
+
+type reduceRereaderRes struct {
+	*reduceSeqRes
+	Rereader Rereader
+}
+
+// ReduceRereader is like ReduceSeq, but for Rereaders.
+func ReduceRereader(r Rereader, present []bool) Rereader {
+	return &reduceRereaderRes{
+		reduceSeqRes: ReduceSeq(r, present).(*reduceSeqRes),
+		Rereader:     r,
+	}
+}
+
+func (r *reduceRereaderRes) Reread(start, end int) <-chan *anyseq.Batch {
+	<-r.Done
+	if start < 0 || end < start || end > r.Len {
+		panic("slice bounds out of range")
+	}
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		for in := range r.Rereader.Reread(start, end) {
+			res <- reduceBatch(in, r.Present)
+		}
+		close(res)
 	}()
 	return res
 }
+
+// reduceBatch removes the sequences from a batch at
+// indices where present is false.
+// If no sequences remain, nil is returned.
+func reduceBatch(in *anyseq.Batch, present []bool) *anyseq.Batch {
+	subset := append([]bool{}, in.Present...)
+	changed := false
+	numPresent := 0
+	for i, mask := range present {
+		if subset[i] {
+			if !mask {
+				changed = true
+				subset[i] = false
+			} else {
+				numPresent++
+			}
+		}
+	}
+	if numPresent == 0 {
+		return nil
+	} else if changed {
+		return in.Reduce(subset)
+	}
+	return in
+}
@@ -0,0 +1,227 @@
+package lazyseq
+
+import (
+	"math"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+)
+
+// A reverseStepFunc computes the carries for a timestep
+// given the inputs at that timestep and the carries from
+// the next timestep.
+//
+// The next carries are nil at the last timestep.
+// Otherwise, sequences which are not present at the next
+// timestep are absent from the next carries.
+//
+// The first carry is the output for the timestep.
+type reverseStepFunc func(ins, next []*anyseq.Batch) []*anyseq.Batch
+
+type reverseScanRes struct {
+	Ins  []Rereader
+	Step reverseStepFunc
+	Out  <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done        <-chan struct{}
+	Presents    [][]bool
+	Interval    int
+	Checkpoints [][]*anyseq.Batch
+}
+
+// DiscountedReturns computes the discounted sum of future
+// rewards at every timestep of every sequence.
+//
+// The output at timestep t is r_t + gamma*r_(t+1) + ...,
+// where the sum stops at the end of the sequence.
+//
+// The result is constant, i.e. it does not back-propagate
+// into rewards.
+//
+// The results are computed backwards in chunks of roughly
+// sqrt(T) timesteps, where T is the length of rewards.
+// Only the carries at the boundaries between chunks and
+// one chunk of rewards are stored at once.
+func DiscountedReturns(rewards Rereader, gamma float64) Rereader {
+	c := rewards.Creator()
+	return newReverseScanRes([]Rereader{rewards},
+		func(ins, next []*anyseq.Batch) []*anyseq.Batch {
+			res := ins[0].Packed.Copy()
+			if next != nil {
+				future := next[0].Expand(ins[0].Present).Packed.Copy()
+				future.Scale(c.MakeNumeric(gamma))
+				res.Add(future)
+			}
+			return []*anyseq.Batch{{Present: ins[0].Present, Packed: res}}
+		})
+}
+
+// GAE computes generalized advantage estimates from a
+// sequence of rewards and a sequence of value estimates.
+//
+// The advantage at timestep t is the sum over k of
+// (gamma*lambda)^k * delta_(t+k), where
+//
+//	delta_t = r_t + gamma*V_(t+1) - V_t
+//
+// The end of a sequence is treated as a terminal state,
+// so the value after the last timestep is 0.
+//
+// The rewards and values must be the same length and have
+// the same present maps.
+// Like DiscountedReturns, the result is constant and
+// only stores roughly sqrt(T) timesteps at once.
+func GAE(rewards, values Rereader, gamma, lambda float64) Rereader {
+	c := rewards.Creator()
+	return newReverseScanRes([]Rereader{rewards, values},
+		func(ins, next []*anyseq.Batch) []*anyseq.Batch {
+			present := ins[0].Present
+			adv := ins[0].Packed.Copy()
+			adv.Sub(ins[1].Packed)
+			if next != nil {
+				nextValue := next[1].Expand(present).Packed.Copy()
+				nextValue.Scale(c.MakeNumeric(gamma))
+				adv.Add(nextValue)
+				nextAdv := next[0].Expand(present).Packed.Copy()
+				nextAdv.Scale(c.MakeNumeric(gamma * lambda))
+				adv.Add(nextAdv)
+			}
+			return []*anyseq.Batch{
+				{Present: present, Packed: adv},
+				ins[1],
+			}
+		})
+}
+
+func newReverseScanRes(ins []Rereader, step reverseStepFunc) *reverseScanRes {
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &reverseScanRes{
+		Ins:  ins,
+		Step: step,
+		Out:  outChan,
+		Done: doneChan,
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (r *reverseScanRes) Creator() anyvec.Creator {
+	return r.Ins[0].Creator()
+}
+
+func (r *reverseScanRes) Forward() <-chan *anyseq.Batch {
+	return r.Out
+}
+
+func (r *reverseScanRes) Vars() anydiff.VarSet {
+	return anydiff.VarSet{}
+}
+
+func (r *reverseScanRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range r.Forward() {
+	}
+	for _ = range upstream {
+	}
+}
+
+func (r *reverseScanRes) Reread(start, end int) <-chan *anyseq.Batch {
+	<-r.Done
+	if start < 0 || end < start || end > len(r.Presents) {
+		panic("slice bounds out of range")
+	}
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		r.emit(start, end, res)
+		close(res)
+	}()
+	return res
+}
+
+func (r *reverseScanRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	var chans []<-chan *anyseq.Batch
+	for _, in := range r.Ins {
+		chans = append(chans, in.Forward())
+	}
+	readLockstep(chans, func(batches []*anyseq.Batch) {
+		r.Presents = append(r.Presents, batches[0].Present)
+	})
+
+	r.Interval = essentials.MaxInt(1,
+		int(math.Ceil(math.Sqrt(float64(len(r.Presents))))))
+	numChunks := (len(r.Presents) + r.Interval - 1) / r.Interval
+	r.Checkpoints = make([][]*anyseq.Batch, numChunks+1)
+	for i := numChunks - 1; i >= 0; i-- {
+		carries := r.chunkCarries(i)
+		r.Checkpoints[i] = carries[0]
+	}
+
+	close(done)
+	r.emit(0, len(r.Presents), out)
+	close(out)
+}
+
+// emit sends the outputs for the timesteps in the range
+// [start, end) to out.
+func (r *reverseScanRes) emit(start, end int, out chan<- *anyseq.Batch) {
+	if start == end {
+		return
+	}
+	for i := start / r.Interval; i*r.Interval < end; i++ {
+		for j, carries := range r.chunkCarries(i) {
+			t := i*r.Interval + j
+			if t >= start && t < end {
+				out <- carries[0]
+			}
+		}
+	}
+}
+
+// chunkCarries computes the carries at every timestep in
+// a chunk, using the checkpoint after the chunk.
+func (r *reverseScanRes) chunkCarries(chunk int) [][]*anyseq.Batch {
+	start := chunk * r.Interval
+	end := essentials.MinInt(start+r.Interval, len(r.Presents))
+	chans := make([]<-chan *anyseq.Batch, len(r.Ins))
+	for i, in := range r.Ins {
+		chans[i] = in.Reread(start, end)
+	}
+	var ins [][]*anyseq.Batch
+	readLockstep(chans, func(batches []*anyseq.Batch) {
+		ins = append(ins, batches)
+	})
+	res := make([][]*anyseq.Batch, len(ins))
+	next := r.Checkpoints[chunk+1]
+	for t := len(ins) - 1; t >= 0; t-- {
+		res[t] = r.Step(ins[t], next)
+		next = res[t]
+	}
+	return res
+}
+
+// readLockstep reads every timestep from the channels,
+// which must produce batches with matching present maps,
+// and calls f with the batches at each timestep.
+func readLockstep(chans []<-chan *anyseq.Batch, f func([]*anyseq.Batch)) {
+	for {
+		var batches []*anyseq.Batch
+		for _, ch := range chans {
+			if batch, ok := <-ch; ok {
+				if len(batches) > 0 &&
+					!presentMapsEqual(batches[0].Present, batch.Present) {
+					panic("present map mismatch")
+				}
+				batches = append(batches, batch)
+			}
+		}
+		if len(batches) == 0 {
+			return
+		} else if len(batches) != len(chans) {
+			panic("sequence length mismatch")
+		}
+		f(batches)
+	}
+}
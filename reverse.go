@@ -0,0 +1,171 @@
+package lazyseq
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+type reverseRes struct {
+	In  Rereader
+	Out <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done     <-chan struct{}
+	Presents [][]bool
+	Lens     []int
+	VecSize  int
+}
+
+// Reverse creates a Rereader which reverses every
+// sequence in r along the time axis.
+//
+// Each sequence is reversed within its own length, so
+// the present maps of the result are the same as the
+// present maps of r.
+//
+// The vector size must be the same at every timestep.
+//
+// The result does not produce any outputs until r has
+// been read completely.
+// Each output timestep is produced by rereading one
+// timestep of r per distinct sequence length.
+// During back-propagation, all of the upstream batches
+// are buffered before any are passed to r.
+func Reverse(r Rereader) Rereader {
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &reverseRes{
+		In:   r,
+		Out:  outChan,
+		Done: doneChan,
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (r *reverseRes) Creator() anyvec.Creator {
+	return r.In.Creator()
+}
+
+func (r *reverseRes) Forward() <-chan *anyseq.Batch {
+	return r.Out
+}
+
+func (r *reverseRes) Vars() anydiff.VarSet {
+	return r.In.Vars()
+}
+
+func (r *reverseRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range r.Forward() {
+	}
+
+	ups := make([]*anyseq.Batch, len(r.Presents))
+	for t := len(ups) - 1; t >= 0; t-- {
+		u, ok := <-upstream
+		if !ok {
+			panic("not enough upstream batches")
+		}
+		ups[t] = u
+	}
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		r.In.Propagate(downstream, grad)
+		wg.Done()
+	}()
+
+	for t := len(r.Presents) - 1; t >= 0; t-- {
+		var rows []anyvec.Vector
+		for lane, pres := range r.Presents[t] {
+			if pres {
+				u := ups[r.Lens[lane]-(t+1)]
+				start, end := seqRangeInBatch(u, lane)
+				rows = append(rows, u.Packed.Slice(start, end))
+			}
+		}
+		downstream <- &anyseq.Batch{
+			Present: r.Presents[t],
+			Packed:  r.Creator().Concat(rows...),
+		}
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+func (r *reverseRes) Reread(start, end int) <-chan *anyseq.Batch {
+	<-r.Done
+	if start < 0 || end < start || end > len(r.Presents) {
+		panic("slice bounds out of range")
+	}
+	out := make(chan *anyseq.Batch, 1)
+	go func() {
+		for t := start; t < end; t++ {
+			out <- r.reversedBatch(t)
+		}
+		close(out)
+	}()
+	return out
+}
+
+func (r *reverseRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	r.VecSize = -1
+	for batch := range r.In.Forward() {
+		if r.Lens == nil {
+			r.Lens = make([]int, len(batch.Present))
+		}
+		for lane, pres := range batch.Present {
+			if pres {
+				r.Lens[lane]++
+			}
+		}
+		vecSize := batch.Packed.Len() / batch.NumPresent()
+		if r.VecSize == -1 {
+			r.VecSize = vecSize
+		} else if r.VecSize != vecSize {
+			panic("vector size must be the same at every timestep")
+		}
+		r.Presents = append(r.Presents, batch.Present)
+	}
+	close(done)
+
+	for t := range r.Presents {
+		out <- r.reversedBatch(t)
+	}
+	close(out)
+}
+
+// reversedBatch computes the output batch at timestep t
+// by rereading the source timestep of each sequence.
+func (r *reverseRes) reversedBatch(t int) *anyseq.Batch {
+	present := r.Presents[t]
+	rows := make([]anyvec.Vector, len(present))
+	for lane, pres := range present {
+		if !pres || rows[lane] != nil {
+			continue
+		}
+		srcTime := r.Lens[lane] - (t + 1)
+		var srcBatch *anyseq.Batch
+		for batch := range r.In.Reread(srcTime, srcTime+1) {
+			srcBatch = batch
+		}
+		for other, otherPres := range present {
+			if otherPres && r.Lens[other] == r.Lens[lane] {
+				start, end := seqRangeInBatch(srcBatch, other)
+				rows[other] = srcBatch.Packed.Slice(start, end)
+			}
+		}
+	}
+	return &anyseq.Batch{
+		Present: present,
+		Packed:  concatSparse(r.Creator(), rows),
+	}
+}
@@ -0,0 +1,311 @@
+package lazyseq
+
+import (
+	"math"
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+)
+
+type cumSumRes struct {
+	In  Seq
+	Out <-chan *anyseq.Batch
+}
+
+// CumSum computes the cumulative sum of each sequence in
+// seq, such that output timestep t is the sum of input
+// timesteps 0 through t.
+//
+// The vector size must be the same at every timestep.
+//
+// Both the forward and backward passes only store a
+// single running sum.
+func CumSum(seq Seq) Seq {
+	outChan := make(chan *anyseq.Batch, 1)
+	res := &cumSumRes{In: seq, Out: outChan}
+	go func() {
+		var sum *anyseq.Batch
+		for batch := range seq.Forward() {
+			packed := batch.Packed.Copy()
+			if sum != nil {
+				packed.Add(sum.Reduce(batch.Present).Packed)
+			}
+			sum = &anyseq.Batch{Present: batch.Present, Packed: packed}
+			outChan <- sum
+		}
+		close(outChan)
+	}()
+	return res
+}
+
+func (c *cumSumRes) Creator() anyvec.Creator {
+	return c.In.Creator()
+}
+
+func (c *cumSumRes) Forward() <-chan *anyseq.Batch {
+	return c.Out
+}
+
+func (c *cumSumRes) Vars() anydiff.VarSet {
+	return c.In.Vars()
+}
+
+func (c *cumSumRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range c.Forward() {
+	}
+
+	downstream := make(chan *anyseq.Batch, 1)
+	go func() {
+		var sum *anyseq.Batch
+		for u := range upstream {
+			packed := u.Packed.Copy()
+			if sum != nil {
+				packed.Add(sum.Expand(u.Present).Packed)
+			}
+			sum = &anyseq.Batch{Present: u.Present, Packed: packed}
+
+			// The receiver may modify its upstream, so the
+			// running sum cannot be sent directly.
+			downstream <- &anyseq.Batch{
+				Present: sum.Present,
+				Packed:  sum.Packed.Copy(),
+			}
+		}
+		close(downstream)
+	}()
+	c.In.Propagate(downstream, grad)
+}
+
+type scanRes struct {
+	In      Rereader
+	Init    anydiff.Res
+	Combine func(acc, x anydiff.Res, n int) anydiff.Res
+	Out     <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done     <-chan struct{}
+	Presents [][]bool
+	V        anydiff.VarSet
+
+	checkpointOnce sync.Once
+	interval       int
+	checkpoints    []*anyseq.Batch
+}
+
+// Scan computes a running accumulation over each sequence
+// in seq.
+//
+// The accumulator for each sequence starts out as init.
+// At every timestep, the accumulator is replaced with the
+// result of combine, which is passed the accumulators and
+// inputs for the present sequences.
+// The combine function is also given the batch size.
+// The result contains the accumulator after every
+// timestep.
+//
+// The forward pass only stores one accumulator per
+// sequence.
+// Rereading and back-propagation store accumulators at
+// intervals of roughly sqrt(T) timesteps, where T is the
+// length of seq, and recompute the accumulators between
+// them as needed.
+// Thus, combine may be called multiple times for the
+// same timestep.
+func Scan(seq Rereader, init anydiff.Res,
+	combine func(acc, x anydiff.Res, n int) anydiff.Res) Rereader {
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &scanRes{
+		In:      seq,
+		Init:    init,
+		Combine: combine,
+		Out:     outChan,
+		Done:    doneChan,
+		V:       init.Vars(),
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (s *scanRes) Creator() anyvec.Creator {
+	return s.In.Creator()
+}
+
+func (s *scanRes) Forward() <-chan *anyseq.Batch {
+	return s.Out
+}
+
+func (s *scanRes) Vars() anydiff.VarSet {
+	<-s.Done
+	return s.V
+}
+
+func (s *scanRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range s.Forward() {
+	}
+	s.computeCheckpoints()
+
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		s.In.Propagate(downstream, grad)
+		wg.Done()
+	}()
+
+	// The gradient with respect to the accumulator that
+	// the next timestep received.
+	var carry *anyseq.Batch
+
+	for i := len(s.checkpoints) - 1; i >= 0; i-- {
+		start := i * s.interval
+		end := essentials.MinInt(start+s.interval, len(s.Presents))
+		var ins []*anyseq.Batch
+		accs := []*anyseq.Batch{s.checkpoints[i]}
+		for batch := range s.In.Reread(start, end) {
+			ins = append(ins, batch)
+			out, _ := s.step(accs[len(accs)-1], batch)
+			accs = append(accs, out)
+		}
+		for j := len(ins) - 1; j >= 0; j-- {
+			u, ok := <-upstream
+			if !ok {
+				panic("not enough upstream batches")
+			}
+			upVec := u.Packed.Copy()
+			if carry != nil {
+				upVec.Add(carry.Expand(u.Present).Packed)
+			}
+			var down *anyseq.Batch
+			down, carry = s.propagateStep(accs[j], ins[j], upVec, grad)
+			downstream <- down
+		}
+	}
+
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+func (s *scanRes) Reread(start, end int) <-chan *anyseq.Batch {
+	<-s.Done
+	if start < 0 || end < start || end > len(s.Presents) {
+		panic("slice bounds out of range")
+	}
+	res := make(chan *anyseq.Batch, 1)
+	if start == end {
+		close(res)
+		return res
+	}
+	s.computeCheckpoints()
+	checkpoint := start / s.interval
+	srcStart := checkpoint * s.interval
+	go func() {
+		acc := s.checkpoints[checkpoint]
+		t := srcStart
+		for batch := range s.In.Reread(srcStart, end) {
+			acc, _ = s.step(acc, batch)
+			if t >= start {
+				res <- acc
+			}
+			t++
+		}
+		close(res)
+	}()
+	return res
+}
+
+func (s *scanRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	var acc *anyseq.Batch
+	for batch := range s.In.Forward() {
+		s.Presents = append(s.Presents, batch.Present)
+		var v anydiff.VarSet
+		acc, v = s.step(acc, batch)
+		s.V = anydiff.MergeVarSets(s.V, v)
+		out <- acc
+	}
+	s.V = anydiff.MergeVarSets(s.V, s.In.Vars())
+	close(done)
+	close(out)
+}
+
+// computeCheckpoints rereads the input to find the
+// accumulators at the start of every interval.
+// A nil checkpoint represents the initial accumulator.
+func (s *scanRes) computeCheckpoints() {
+	s.checkpointOnce.Do(func() {
+		s.interval = essentials.MaxInt(1,
+			int(math.Ceil(math.Sqrt(float64(len(s.Presents))))))
+		var acc *anyseq.Batch
+		var t int
+		for batch := range s.In.Reread(0, len(s.Presents)) {
+			if t%s.interval == 0 {
+				s.checkpoints = append(s.checkpoints, acc)
+			}
+			acc, _ = s.step(acc, batch)
+			t++
+		}
+	})
+}
+
+// step applies the combine function to an accumulator
+// and an input batch.
+// A nil accumulator represents the initial accumulator.
+func (s *scanRes) step(acc, in *anyseq.Batch) (*anyseq.Batch, anydiff.VarSet) {
+	out := s.Combine(s.accRes(acc, in), anydiff.NewConst(in.Packed), in.NumPresent())
+	return &anyseq.Batch{Present: in.Present, Packed: out.Output()}, out.Vars()
+}
+
+// propagateStep back-propagates through a single call to
+// the combine function, returning the gradients for the
+// input and the accumulator.
+//
+// If acc is nil, the gradient for the accumulator is
+// propagated through s.Init and the resulting carry is
+// nil.
+func (s *scanRes) propagateStep(acc, in *anyseq.Batch, upstream anyvec.Vector,
+	grad Grad) (down, carry *anyseq.Batch) {
+	inPool := anydiff.NewVar(in.Packed)
+	var accPool *anydiff.Var
+	var accRes anydiff.Res
+	if acc == nil {
+		accRes = s.accRes(nil, in)
+	} else {
+		accPool = anydiff.NewVar(acc.Reduce(in.Present).Packed)
+		accRes = accPool
+	}
+
+	grad.Use(func(g anydiff.Grad) {
+		g[inPool] = inPool.Vector.Creator().MakeVector(inPool.Vector.Len())
+		if accPool != nil {
+			g[accPool] = accPool.Vector.Creator().MakeVector(accPool.Vector.Len())
+		}
+		out := s.Combine(accRes, inPool, in.NumPresent())
+		out.Propagate(upstream, g)
+		down = &anyseq.Batch{Present: in.Present, Packed: g[inPool]}
+		delete(g, inPool)
+		if accPool != nil {
+			carry = &anyseq.Batch{Present: in.Present, Packed: g[accPool]}
+			delete(g, accPool)
+		}
+	})
+
+	return
+}
+
+// accRes creates a Res for the accumulators of the
+// sequences present in an input batch.
+func (s *scanRes) accRes(acc, in *anyseq.Batch) anydiff.Res {
+	if acc != nil {
+		return anydiff.NewConst(acc.Reduce(in.Present).Packed)
+	}
+	initSize := s.Init.Output().Len()
+	zeros := s.Creator().MakeVector(initSize * in.NumPresent())
+	return anydiff.AddRepeated(anydiff.NewConst(zeros), s.Init)
+}
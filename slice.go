@@ -0,0 +1,128 @@
+package lazyseq
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+type sliceRes struct {
+	In    Rereader
+	Start int
+	End   int
+	Out   <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done       <-chan struct{}
+	Presents   [][]bool
+	PackedLens []int
+}
+
+// Slice creates a Rereader with the timesteps in the
+// range [start, end) of r.
+//
+// If end is -1 or is past the end of r, then the slice
+// extends to the end of r.
+//
+// During back-propagation, the timesteps outside of the
+// range receive zero gradients.
+func Slice(r Rereader, start, end int) Rereader {
+	if start < 0 || (end < start && end != -1) {
+		panic("invalid slice bounds")
+	}
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &sliceRes{
+		In:    r,
+		Start: start,
+		End:   end,
+		Out:   outChan,
+		Done:  doneChan,
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (s *sliceRes) Creator() anyvec.Creator {
+	return s.In.Creator()
+}
+
+func (s *sliceRes) Forward() <-chan *anyseq.Batch {
+	return s.Out
+}
+
+func (s *sliceRes) Vars() anydiff.VarSet {
+	return s.In.Vars()
+}
+
+func (s *sliceRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range s.Forward() {
+	}
+
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		s.In.Propagate(downstream, grad)
+		wg.Done()
+	}()
+
+	for t := len(s.Presents) - 1; t >= 0; t-- {
+		if s.inRange(t) {
+			u, ok := <-upstream
+			if !ok {
+				panic("not enough upstream batches")
+			}
+			downstream <- u
+		} else {
+			downstream <- &anyseq.Batch{
+				Present: s.Presents[t],
+				Packed:  s.In.Creator().MakeVector(s.PackedLens[t]),
+			}
+		}
+	}
+
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+func (s *sliceRes) Reread(start, end int) <-chan *anyseq.Batch {
+	<-s.Done
+	if start < 0 || end < start || end > s.length() {
+		panic("slice bounds out of range")
+	}
+	return s.In.Reread(s.Start+start, s.Start+end)
+}
+
+func (s *sliceRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	for batch := range s.In.Forward() {
+		if s.inRange(len(s.Presents)) {
+			out <- batch
+		}
+		s.Presents = append(s.Presents, batch.Present)
+		s.PackedLens = append(s.PackedLens, batch.Packed.Len())
+	}
+	close(done)
+	close(out)
+}
+
+func (s *sliceRes) inRange(t int) bool {
+	return t >= s.Start && (t < s.End || s.End == -1)
+}
+
+func (s *sliceRes) length() int {
+	end := len(s.Presents)
+	if s.End != -1 && s.End < end {
+		end = s.End
+	}
+	if end < s.Start {
+		return 0
+	}
+	return end - s.Start
+}
@@ -0,0 +1,242 @@
+package lazyseq
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+type teeState struct {
+	In Seq
+	N  int
+
+	Lock sync.Mutex
+	Cond *sync.Cond
+
+	// Progress and Done track the upstream batches read
+	// by each call to Propagate, in the order the calls
+	// were made.
+	Progress []int
+	Done     []bool
+
+	// Sum stores the partial sums of the upstream batches
+	// which the last call has not yet reached.
+	Sum []*anyseq.Batch
+}
+
+type teeSeq struct {
+	*teeState
+	Out <-chan *anyseq.Batch
+}
+
+// Tee creates n Seqs which all produce the outputs of
+// seq.
+//
+// The results may be read at different rates.
+// Batches which one result has produced but another has
+// not are buffered.
+//
+// The upstream gradients of the results are summed one
+// timestep at a time and propagated through seq once.
+// The last result to be propagated through streams the
+// sum into seq as its own upstream batches arrive.
+// Upstream batches of the other results are kept until
+// the last result reaches them, so propagating through
+// the results one after another (rather than
+// concurrently) buffers O(T) upstream batches.
+//
+// Nothing is propagated through seq until every result
+// has been propagated through.
+// Thus, either all or none of the results should be
+// propagated through; otherwise, the gradients are
+// silently dropped.
+func Tee(seq Seq, n int) []Seq {
+	state := &teeState{In: seq, N: n}
+	state.Cond = sync.NewCond(&state.Lock)
+	res := make([]Seq, n)
+	for i, out := range fanOut(seq.Forward(), n) {
+		res[i] = &teeSeq{teeState: state, Out: out}
+	}
+	return res
+}
+
+func (t *teeSeq) Creator() anyvec.Creator {
+	return t.In.Creator()
+}
+
+func (t *teeSeq) Forward() <-chan *anyseq.Batch {
+	return t.Out
+}
+
+func (t *teeSeq) Vars() anydiff.VarSet {
+	return t.In.Vars()
+}
+
+func (t *teeSeq) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range t.Forward() {
+	}
+
+	t.Lock.Lock()
+	idx := len(t.Progress)
+	t.Progress = append(t.Progress, 0)
+	t.Done = append(t.Done, false)
+	t.Lock.Unlock()
+
+	if idx < t.N-1 {
+		t.accumulate(idx, upstream)
+	} else {
+		t.In.Propagate(t.streamSum(upstream), grad)
+	}
+}
+
+// accumulate adds upstream batches into the partial sums.
+func (t *teeState) accumulate(idx int, upstream <-chan *anyseq.Batch) {
+	for batch := range upstream {
+		t.Lock.Lock()
+		if i := t.Progress[idx]; i == len(t.Sum) {
+			t.Sum = append(t.Sum, batch)
+		} else {
+			t.Sum[i].Packed.Add(batch.Packed)
+		}
+		t.Progress[idx]++
+		t.Cond.Broadcast()
+		t.Lock.Unlock()
+	}
+	t.Lock.Lock()
+	t.Done[idx] = true
+	t.Cond.Broadcast()
+	t.Lock.Unlock()
+}
+
+// streamSum adds the partial sums to upstream batches as
+// soon as every other call to Propagate has accumulated
+// them.
+func (t *teeState) streamSum(upstream <-chan *anyseq.Batch) <-chan *anyseq.Batch {
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		var count int
+		for batch := range upstream {
+			t.Lock.Lock()
+			for !t.othersPast(count) {
+				t.Cond.Wait()
+			}
+			if count < len(t.Sum) {
+				batch.Packed.Add(t.Sum[count].Packed)
+				t.Sum[count] = nil
+			} else if t.N > 1 {
+				t.Lock.Unlock()
+				panic("upstream length mismatch")
+			}
+			t.Lock.Unlock()
+			res <- batch
+			count++
+		}
+
+		t.Lock.Lock()
+		for !t.othersPast(-1) {
+			t.Cond.Wait()
+		}
+		var mismatch bool
+		for _, n := range t.Progress[:t.N-1] {
+			mismatch = mismatch || n != count
+		}
+		t.Progress = nil
+		t.Done = nil
+		t.Sum = nil
+		t.Lock.Unlock()
+		if mismatch {
+			panic("upstream length mismatch")
+		}
+
+		close(res)
+	}()
+	return res
+}
+
+// othersPast checks if every call to Propagate but the
+// last has read more than count upstream batches or has
+// finished.
+// If count is -1, it checks that every call has finished.
+func (t *teeState) othersPast(count int) bool {
+	for i := 0; i < t.N-1; i++ {
+		if !t.Done[i] && (count < 0 || t.Progress[i] <= count) {
+			return false
+		}
+	}
+	return true
+}
+
+type teeRereader struct {
+	*teeSeq
+	Rereader Rereader
+}
+
+// TeeRereader is like Tee, but for Rereaders.
+func TeeRereader(r Rereader, n int) []Rereader {
+	res := make([]Rereader, n)
+	for i, seq := range Tee(r, n) {
+		res[i] = &teeRereader{teeSeq: seq.(*teeSeq), Rereader: r}
+	}
+	return res
+}
+
+func (t *teeRereader) Reread(start, end int) <-chan *anyseq.Batch {
+	return t.Rereader.Reread(start, end)
+}
+
+// fanOut sends every batch from in to n channels.
+//
+// Each channel is buffered, so that one slow reader does
+// not prevent the other channels from being sent batches.
+func fanOut(in <-chan *anyseq.Batch, n int) []<-chan *anyseq.Batch {
+	ins := make([]chan *anyseq.Batch, n)
+	outs := make([]<-chan *anyseq.Batch, n)
+	for i := range ins {
+		ins[i] = make(chan *anyseq.Batch, 1)
+		outs[i] = bufferBatches(ins[i])
+	}
+	go func() {
+		for batch := range in {
+			for _, ch := range ins {
+				ch <- batch
+			}
+		}
+		for _, ch := range ins {
+			close(ch)
+		}
+	}()
+	return outs
+}
+
+// bufferBatches relays batches from in to the result,
+// storing as many batches as necessary to avoid blocking
+// the sender.
+func bufferBatches(in <-chan *anyseq.Batch) <-chan *anyseq.Batch {
+	out := make(chan *anyseq.Batch)
+	go func() {
+		defer close(out)
+		var queue []*anyseq.Batch
+		for in != nil || len(queue) > 0 {
+			var sendChan chan<- *anyseq.Batch
+			var next *anyseq.Batch
+			if len(queue) > 0 {
+				sendChan = out
+				next = queue[0]
+			}
+			select {
+			case batch, ok := <-in:
+				if ok {
+					queue = append(queue, batch)
+				} else {
+					in = nil
+				}
+			case sendChan <- next:
+				queue[0] = nil
+				queue = queue[1:]
+			}
+		}
+	}()
+	return out
+}
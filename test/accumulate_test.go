@@ -0,0 +1,72 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestAccumulator(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	params := anydiff.NewVarSet(block.Parameters()...)
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 1, 0, 5),
+		testSeqsLen(c, inSize, 7, 1, 3),
+	}
+
+	meanUpstream := c.MakeVector(outSize)
+	anyvec.Rand(meanUpstream, anyvec.Normal, nil)
+
+	// Compute the expected gradient by scaling the
+	// upstream vectors.
+	expected := anydiff.NewGrad(params.Slice()...)
+	meanU := meanUpstream.Copy()
+	meanU.Scale(c.MakeNumeric(0.25))
+	lazyseq.Mean(lazyrnn.BPTT(lazyseq.Lazify(seqs[0]), block)).Propagate(meanU,
+		expected)
+	seqExpected := computeGradient(anyrnn.Map(seqs[1], block), params)
+	for v, vec := range seqExpected {
+		vec.Scale(c.MakeNumeric(0.75))
+		expected[v].Add(vec)
+	}
+
+	acc := lazyseq.NewAccumulator(anydiff.NewGrad(params.Slice()...))
+	for i := 0; i < 2; i++ {
+		acc.PropagateRes(lazyseq.Mean(lazyrnn.BPTT(lazyseq.Lazify(seqs[0]), block)),
+			meanUpstream, 0.25)
+		acc.Zero()
+		if acc.Steps() != 0 {
+			t.Fatal("expected zero steps")
+		}
+	}
+	acc.PropagateRes(lazyseq.Mean(lazyrnn.BPTT(lazyseq.Lazify(seqs[0]), block)),
+		meanUpstream, 0.25)
+
+	seq := lazyrnn.BPTT(lazyseq.Lazify(seqs[1]), block)
+	var outs []*anyseq.Batch
+	for batch := range seq.Forward() {
+		outs = append(outs, batch)
+	}
+	recorder := &upstreamRecorder{Batches: outs}
+	computeGradient(recorder, anydiff.VarSet{})
+	upstream := make(chan *anyseq.Batch, len(outs))
+	for i := len(recorder.Upstream) - 1; i >= 0; i-- {
+		upstream <- recorder.Upstream[i]
+	}
+	close(upstream)
+	acc.PropagateSeq(seq, upstream, 0.75)
+
+	if acc.Steps() != 2 {
+		t.Errorf("expected 2 steps but got %d", acc.Steps())
+	}
+	gradientsEquivalent(t, acc.Snapshot(), expected)
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+	"github.com/unixpickle/lazyseq/lazyseqtest"
+)
+
+func TestDecodeChunks(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	encSeqs := testSeqsLen(c, outSize, 4, 0, 3, 5)
+	decSeqs := testSeqsLen(c, inSize, 2, 3, 1, 4)
+
+	scale := anydiff.NewVar(c.MakeVector(1))
+	anyvec.Rand(scale.Vector, anyvec.Normal, nil)
+	attn := func(query, keys anydiff.Res, n int) anydiff.Res {
+		products := anydiff.Mul(query, keys)
+		logits := anydiff.SumCols(&anydiff.Matrix{
+			Data: products,
+			Rows: n,
+			Cols: outSize,
+		})
+		return anydiff.ScaleRepeated(logits, scale)
+	}
+
+	decode := func(chunkSize int) func() anyseq.Seq {
+		return func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyrnn.Decode(lazyseq.Lazify(encSeqs),
+				lazyseq.Lazify(decSeqs), block, attn, chunkSize))
+		}
+	}
+
+	for _, chunkSize := range []int{1, 2} {
+		testEquivalent(t, decode(chunkSize), decode(100))
+	}
+}
+
+func TestDecodeUniform(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	encSeqs := testSeqsLen(c, outSize, 4, 0, 3)
+	decSeqs := testSeqsLen(c, inSize, 2, 3, 1)
+
+	attn := func(query, keys anydiff.Res, n int) anydiff.Res {
+		return anydiff.NewConst(c.MakeVector(n))
+	}
+
+	actual := lazyseq.Unlazify(lazyrnn.Decode(lazyseq.Lazify(encSeqs),
+		lazyseq.Lazify(decSeqs), block, attn, 2)).Output()
+	queries := anyrnn.Map(decSeqs, block).Output()
+
+	var means [][]float64
+	for _, seq := range anyseq.SeparateSeqs(encSeqs.Output()) {
+		mean := make([]float64, outSize)
+		for _, vec := range seq {
+			for i, x := range vec.Data().([]float64) {
+				mean[i] += x / float64(len(seq))
+			}
+		}
+		means = append(means, mean)
+	}
+
+	for step, batch := range actual {
+		var expected []float64
+		var row int
+		for lane, p := range batch.Present {
+			if !p {
+				continue
+			}
+			query := queries[step].Packed.Data().([]float64)
+			expected = append(expected, query[row*outSize:(row+1)*outSize]...)
+			expected = append(expected, means[lane]...)
+			row++
+		}
+		diff := batch.Packed.Copy()
+		diff.Sub(c.MakeVectorData(expected))
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("timestep %d: expected %v but got %v", step, expected,
+				batch.Packed.Data())
+		}
+	}
+}
+
+func TestDecodeGradients(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	encSeqs := testSeqsLen(c, outSize, 4, 0, 3, 5)
+	decSeqs := testSeqsLen(c, inSize, 2, 3, 1, 4)
+
+	scale := anydiff.NewVar(c.MakeVector(1))
+	anyvec.Rand(scale.Vector, anyvec.Normal, nil)
+	attn := func(query, keys anydiff.Res, n int) anydiff.Res {
+		products := anydiff.Mul(query, keys)
+		logits := anydiff.SumCols(&anydiff.Matrix{
+			Data: products,
+			Rows: n,
+			Cols: outSize,
+		})
+		return anydiff.ScaleRepeated(logits, scale)
+	}
+
+	for _, chunkSize := range []int{1, 3} {
+		t.Run(fmt.Sprintf("Chunk%d", chunkSize), func(t *testing.T) {
+			lazyseqtest.CheckGradients(t, func() lazyseq.Seq {
+				return lazyrnn.Decode(lazyseq.Lazify(encSeqs), lazyseq.Lazify(decSeqs),
+					block, attn, chunkSize)
+			}, nil, 1e-5, 1e-4)
+		})
+	}
+}
+
+func TestDecodeEmptyEncoder(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	encSeqs := testSeqsLen(c, outSize, 0, 0)
+	decSeqs := testSeqsLen(c, inSize, 2, 3)
+
+	attn := func(query, keys anydiff.Res, n int) anydiff.Res {
+		panic("attention should not be computed")
+	}
+
+	actual := func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyrnn.Decode(lazyseq.Lazify(encSeqs),
+			lazyseq.Lazify(decSeqs), block, attn, 2))
+	}
+	expected := func() anyseq.Seq {
+		return anyrnn.Map(decSeqs, block)
+	}
+	testEquivalent(t, actual, expected)
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestCheckedStrategy(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	inSeqs := testSeqs(c, inSize)
+
+	strategy := lazyrnn.CheckedStrategy(lazyrnn.HSMStrategy(2, 2, true), 1e-8,
+		func(m *lazyrnn.Mismatch) {
+			t.Error(m)
+		})
+
+	testEquivalent(t, func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyrnn.ApplyStrategy(strategy,
+			lazyseq.Lazify(inSeqs), block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(inSeqs, block)
+	})
+}
+
+func TestCheckedStrategyMismatch(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewVanilla(c, inSize, outSize, anynet.Tanh)
+	otherBlock := anyrnn.NewVanilla(c, inSize, outSize, anynet.Tanh)
+	inSeqs := testSeqsLen(c, inSize, 3, 5)
+
+	// A broken strategy which uses the wrong block.
+	broken := func(in *lazyrnn.RereaderFragment, b anyrnn.Block,
+		start anyrnn.State) lazyrnn.Fragment {
+		return lazyrnn.BPTTStrategy(in, otherBlock, start)
+	}
+
+	var mismatches []*lazyrnn.Mismatch
+	strategy := lazyrnn.CheckedStrategy(broken, 1e-8, func(m *lazyrnn.Mismatch) {
+		mismatches = append(mismatches, m)
+	})
+	out := lazyseq.Unlazify(lazyrnn.ApplyStrategy(strategy, lazyseq.Lazify(inSeqs),
+		block))
+
+	if len(mismatches) != 1 {
+		t.Fatalf("expected 1 mismatch but got %d", len(mismatches))
+	}
+	if mismatches[0].Kind != "output" || mismatches[0].Time != 0 {
+		t.Errorf("unexpected mismatch: %v", mismatches[0])
+	}
+
+	vars := append(inSeqs.Vars().Slice(), anynet.AllParameters(block)...)
+	vars = append(vars, anynet.AllParameters(otherBlock)...)
+	out.Propagate(out.Output(), anydiff.NewGrad(vars...))
+	if len(mismatches) != 4 {
+		t.Fatalf("expected 4 mismatches but got %d", len(mismatches))
+	}
+	if mismatches[1].Kind != "input gradient" || mismatches[1].Time != 0 {
+		t.Errorf("unexpected mismatch: %v", mismatches[1])
+	}
+	if mismatches[2].Kind != "parameter gradient" {
+		t.Errorf("unexpected mismatch: %v", mismatches[2])
+	}
+	if mismatches[3].Kind != "state gradient" || mismatches[3].Time != 0 {
+		t.Errorf("unexpected mismatch: %v", mismatches[3])
+	}
+}
+
+func TestCheckedStrategyStateMismatch(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewVanilla(c, inSize, outSize, anynet.Tanh)
+	inSeqs := testSeqsLen(c, inSize, 3, 5)
+
+	// A broken strategy which gets everything right except
+	// for the gradient of the start state.
+	broken := func(in *lazyrnn.RereaderFragment, b anyrnn.Block,
+		start anyrnn.State) lazyrnn.Fragment {
+		return &scaledStateFrag{lazyrnn.BPTTStrategy(in, b, start)}
+	}
+
+	var mismatches []*lazyrnn.Mismatch
+	strategy := lazyrnn.CheckedStrategy(broken, 1e-8, func(m *lazyrnn.Mismatch) {
+		mismatches = append(mismatches, m)
+	})
+	out := lazyseq.Unlazify(lazyrnn.ApplyStrategy(strategy, lazyseq.Lazify(inSeqs),
+		block))
+
+	vars := append(inSeqs.Vars().Slice(), anynet.AllParameters(block)...)
+	out.Propagate(out.Output(), anydiff.NewGrad(vars...))
+	if len(mismatches) != 1 {
+		t.Fatalf("expected 1 mismatch but got %d", len(mismatches))
+	}
+	if mismatches[0].Kind != "state gradient" || mismatches[0].Time != 0 {
+		t.Errorf("unexpected mismatch: %v", mismatches[0])
+	}
+}
+
+func TestCheckedStrategyReadAhead(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	inSeqs := testSeqsLen(c, inSize, 4, 6, 2)
+
+	// A strategy which reads every input before it
+	// produces any outputs.
+	readAhead := func(in *lazyrnn.RereaderFragment, b anyrnn.Block,
+		start anyrnn.State) lazyrnn.Fragment {
+		var batches []*anyseq.Batch
+		for batch := range in.Forward {
+			batches = append(batches, batch)
+		}
+		buffered := make(chan *anyseq.Batch, len(batches))
+		for _, batch := range batches {
+			buffered <- batch
+		}
+		close(buffered)
+		return lazyrnn.BPTTStrategy(&lazyrnn.RereaderFragment{
+			Offset:   in.Offset,
+			Forward:  buffered,
+			Rereader: in.Rereader,
+		}, b, start)
+	}
+
+	strategy := lazyrnn.CheckedStrategy(readAhead, 1e-8, func(m *lazyrnn.Mismatch) {
+		t.Error(m)
+	})
+
+	testEquivalent(t, func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyrnn.ApplyStrategy(strategy,
+			lazyseq.Lazify(inSeqs), block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(inSeqs, block)
+	})
+}
+
+// scaledStateFrag doubles the state gradient produced by
+// a Fragment.
+type scaledStateFrag struct {
+	lazyrnn.Fragment
+}
+
+func (s *scaledStateFrag) Propagate(down chan<- *anyseq.Batch, up <-chan *anyseq.Batch,
+	stateUp anyrnn.StateGrad, grad lazyseq.Grad) anyrnn.StateGrad {
+	stateDown := s.Fragment.Propagate(down, up, stateUp, grad)
+	vecState, ok := stateDown.(*anyrnn.VecState)
+	if !ok {
+		return stateDown
+	}
+	scaled := vecState.Vector.Copy()
+	scaled.Scale(scaled.Creator().MakeNumeric(2))
+	return &anyrnn.VecState{Vector: scaled, PresentMap: vecState.PresentMap}
+}
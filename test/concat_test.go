@@ -0,0 +1,91 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestConcatTime(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 3, 3, 2, 3),
+		testSeqsLen(c, inSize, 2, 0, 0, 4),
+		testSeqsLen(c, inSize, 1, 0, 0, 1),
+	}
+
+	testEquivalent(t, func() anyseq.Seq {
+		var lazySeqs []lazyseq.Seq
+		for _, s := range seqs {
+			lazySeqs = append(lazySeqs, lazyseq.Lazify(s))
+		}
+		return lazyseq.Unlazify(lazyseq.ConcatTime(lazySeqs...))
+	}, func() anyseq.Seq {
+		return &timeConcatSeq{Seqs: seqs}
+	})
+}
+
+func TestConcatTimeRereader(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 3, 3, 2, 3),
+		testSeqsLen(c, inSize, 2, 0, 0, 4),
+		testSeqsLen(c, inSize, 1, 0, 0, 1),
+	}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	testEquivalent(t, func() anyseq.Seq {
+		var lazySeqs []lazyseq.Rereader
+		for _, s := range seqs {
+			lazySeqs = append(lazySeqs, lazyseq.Lazify(s))
+		}
+		joined := lazyseq.ConcatTimeRereader(lazySeqs...)
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(2, true, joined, block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(&timeConcatSeq{Seqs: seqs}, block)
+	})
+}
+
+// timeConcatSeq is an anyseq.Seq which joins other
+// anyseq.Seqs along the time axis.
+type timeConcatSeq struct {
+	Seqs []anyseq.Seq
+}
+
+func (t *timeConcatSeq) Creator() anyvec.Creator {
+	return t.Seqs[0].Creator()
+}
+
+func (t *timeConcatSeq) Output() []*anyseq.Batch {
+	var res []*anyseq.Batch
+	for _, s := range t.Seqs {
+		res = append(res, s.Output()...)
+	}
+	return res
+}
+
+func (t *timeConcatSeq) Vars() anydiff.VarSet {
+	res := anydiff.VarSet{}
+	for _, s := range t.Seqs {
+		res = anydiff.MergeVarSets(res, s.Vars())
+	}
+	return res
+}
+
+func (t *timeConcatSeq) Propagate(u []*anyseq.Batch, g anydiff.Grad) {
+	var offset int
+	for _, s := range t.Seqs {
+		n := len(s.Output())
+		s.Propagate(u[offset:offset+n], g)
+		offset += n
+	}
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestConv1D(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 5)
+
+	for _, shape := range [][2]int{{1, 1}, {3, 1}, {3, 2}, {2, 5}} {
+		width, dilation := shape[0], shape[1]
+		kernel := anydiff.NewVar(c.MakeVector(width * inSize * outSize))
+		anyvec.Rand(kernel.Vector, anyvec.Normal, nil)
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyseq.Conv1D(lazyseq.Lazify(inSeqs), kernel,
+				width, dilation))
+		}, func() anyseq.Seq {
+			return newConvSeq(inSeqs, kernel, width, dilation)
+		})
+	}
+}
+
+func TestConv1DReread(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 5)
+	kernel := anydiff.NewVar(c.MakeVector(3 * inSize * outSize))
+	anyvec.Rand(kernel.Vector, anyvec.Normal, nil)
+	block := anyrnn.NewLSTM(c, outSize, outSize)
+
+	testEquivalent(t, func() anyseq.Seq {
+		conv := lazyseq.Conv1D(lazyseq.Lazify(inSeqs), kernel, 3, 2)
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(2, true, conv, block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(newConvSeq(inSeqs, kernel, 3, 2), block)
+	})
+}
+
+// convSeq is a reference implementation of Conv1D which
+// computes each output row separately.
+type convSeq struct {
+	In     anyseq.Seq
+	Kernel anydiff.Res
+	InVars []*anydiff.Var
+	Outs   []anydiff.Res
+	Batch  []*anyseq.Batch
+}
+
+func newConvSeq(in anyseq.Seq, kernel anydiff.Res, width, dilation int) *convSeq {
+	res := &convSeq{In: in, Kernel: kernel}
+	ins := in.Output()
+	for _, batch := range ins {
+		res.InVars = append(res.InVars, anydiff.NewVar(batch.Packed))
+	}
+	for t, batch := range ins {
+		inSize := batch.Packed.Len() / batch.NumPresent()
+		outSize := kernel.Output().Len() / (width * inSize)
+		matSize := inSize * outSize
+		var rows []anydiff.Res
+		for lane, pres := range batch.Present {
+			if !pres {
+				continue
+			}
+			var sum anydiff.Res
+			for j := 0; j < width; j++ {
+				src := t - j*dilation
+				if src < 0 {
+					break
+				}
+				var idx int
+				for _, p := range ins[src].Present[:lane] {
+					if p {
+						idx++
+					}
+				}
+				row := anydiff.Slice(res.InVars[src], idx*inSize, (idx+1)*inSize)
+				product := anydiff.MatMul(false, true,
+					&anydiff.Matrix{Data: row, Rows: 1, Cols: inSize},
+					&anydiff.Matrix{
+						Data: anydiff.Slice(kernel, j*matSize, (j+1)*matSize),
+						Rows: outSize,
+						Cols: inSize,
+					}).Data
+				if sum == nil {
+					sum = product
+				} else {
+					sum = anydiff.Add(sum, product)
+				}
+			}
+			rows = append(rows, sum)
+		}
+		out := anydiff.Concat(rows...)
+		res.Outs = append(res.Outs, out)
+		res.Batch = append(res.Batch, &anyseq.Batch{
+			Present: batch.Present,
+			Packed:  out.Output(),
+		})
+	}
+	return res
+}
+
+func (c *convSeq) Creator() anyvec.Creator {
+	return c.In.Creator()
+}
+
+func (c *convSeq) Output() []*anyseq.Batch {
+	return c.Batch
+}
+
+func (c *convSeq) Vars() anydiff.VarSet {
+	return anydiff.MergeVarSets(c.In.Vars(), c.Kernel.Vars())
+}
+
+func (c *convSeq) Propagate(u []*anyseq.Batch, g anydiff.Grad) {
+	for _, v := range c.InVars {
+		g[v] = v.Vector.Creator().MakeVector(v.Vector.Len())
+	}
+	for t, out := range c.Outs {
+		out.Propagate(u[t].Packed, g)
+	}
+	var downstream []*anyseq.Batch
+	for t, v := range c.InVars {
+		downstream = append(downstream, &anyseq.Batch{
+			Present: c.In.Output()[t].Present,
+			Packed:  g[v],
+		})
+		delete(g, v)
+	}
+	c.In.Propagate(downstream, g)
+}
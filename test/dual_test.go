@@ -0,0 +1,342 @@
+package test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestLazifyDual(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	in := dualTestBatches(c, 3, 2, 3, 0, 1)
+	tangents := randomTangents(batchVars(in)...)
+
+	testDualEquivalent(t, tangents, func() lazyseq.DualSeq {
+		return lazyseq.LazifyDual(anyseq.ResSeq(c, in), tangentSeq(c, in, tangents))
+	}, func() anyseq.Seq {
+		return anyseq.ResSeq(c, in)
+	})
+}
+
+func TestMapNDual(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	in1 := dualTestBatches(c, 3, 2, 3, 0, 1)
+	in2 := dualTestBatches(c, 3, 2, 3, 0, 1)
+	scaler := anydiff.NewVar(c.MakeVector(3))
+	anyvec.Rand(scaler.Vector, anyvec.Normal, nil)
+	tangents := randomTangents(append(append(batchVars(in1), batchVars(in2)...),
+		scaler)...)
+
+	f := func(n int, v ...anydiff.Res) anydiff.Res {
+		return anydiff.Mul(anydiff.ScaleRepeated(v[0], scaler), anydiff.Tanh(v[1]))
+	}
+	testDualEquivalent(t, tangents, func() lazyseq.DualSeq {
+		return lazyseq.MapNDual(f, lazyseq.Tangents{scaler: tangents[scaler]},
+			lazyseq.LazifyDual(anyseq.ResSeq(c, in1), tangentSeq(c, in1, tangents)),
+			lazyseq.LazifyDual(anyseq.ResSeq(c, in2), tangentSeq(c, in2, tangents)))
+	}, func() anyseq.Seq {
+		return anyseq.MapN(f, anyseq.ResSeq(c, in1), anyseq.ResSeq(c, in2))
+	})
+}
+
+func TestPackDual(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	in1 := dualTestBatches(c, 2, 2, 3, 0, 1)
+	in2 := dualTestBatches(c, 2, 4, 1)
+	tangents := randomTangents(append(batchVars(in1), batchVars(in2)...)...)
+
+	testDualEquivalent(t, tangents, func() lazyseq.DualSeq {
+		return lazyseq.PackDual(c, []lazyseq.DualSeq{
+			lazyseq.LazifyDual(anyseq.ResSeq(c, in1), tangentSeq(c, in1, tangents)),
+			lazyseq.LazifyDual(anyseq.ResSeq(c, in2), tangentSeq(c, in2, tangents)),
+		})
+	}, func() anyseq.Seq {
+		return packAnyseq(c, []anyseq.Seq{anyseq.ResSeq(c, in1), anyseq.ResSeq(c, in2)})
+	})
+}
+
+func TestTailMeanDual(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	in := dualTestBatches(c, 2, 2, 3, 0, 1)
+	tangents := randomTangents(batchVars(in)...)
+
+	reductions := map[string]func(s lazyseq.Seq) anydiff.Res{
+		"Tail": lazyseq.Tail,
+		"Mean": lazyseq.Mean,
+	}
+	dualReductions := map[string]func(s lazyseq.DualSeq) (out, tangent anyvec.Vector){
+		"Tail": lazyseq.TailDual,
+		"Mean": lazyseq.MeanDual,
+	}
+	for name, reduce := range reductions {
+		actOut, actTangent := dualReductions[name](
+			lazyseq.LazifyDual(anyseq.ResSeq(c, in), tangentSeq(c, in, tangents)),
+		)
+		expected := reduce(lazyseq.Lazify(anyseq.ResSeq(c, in)))
+		if !vectorsClose(actOut, expected.Output(), 1e-4) {
+			t.Errorf("%s: expected output %v but got %v", name,
+				expected.Output().Data(), actOut.Data())
+		}
+		upstream := randomVector(c, actOut.Len())
+		grad := anydiff.NewGrad(batchVars(in)...)
+		expected.Propagate(upstream.Copy(), grad)
+		if !dotsClose(upstream.Dot(actTangent).(float64), tangentDot(grad, tangents)) {
+			t.Errorf("%s: tangent does not match gradient", name)
+		}
+	}
+}
+
+func TestRNNDual(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	const size = 3
+	in := dualTestBatches(c, size, 2, 3, 0, 1)
+	block := &scanDualBlock{Weights: anydiff.NewVar(c.MakeVector(size))}
+	anyvec.Rand(block.Weights.Vector, anyvec.Normal, nil)
+	tangents := randomTangents(append(batchVars(in), block.Weights)...)
+	block.WeightsTangent = tangents[block.Weights]
+
+	testDualEquivalent(t, tangents, func() lazyseq.DualSeq {
+		return lazyrnn.Dual(
+			lazyseq.LazifyDual(anyseq.ResSeq(c, in), tangentSeq(c, in, tangents)),
+			block,
+		)
+	}, func() anyseq.Seq {
+		// Reverse-mode reference for the same recurrence.
+		init := anydiff.NewConst(c.MakeVector(size))
+		return lazyseq.Unlazify(lazyseq.Scan(lazyseq.Lazify(anyseq.ResSeq(c, in)), init,
+			func(acc, x anydiff.Res, n int) anydiff.Res {
+				return anydiff.Tanh(anydiff.Add(anydiff.ScaleRepeated(acc, block.Weights), x))
+			}))
+	})
+}
+
+// testDualEquivalent checks the outputs of a DualSeq
+// against an anyseq.Seq and checks its tangents against
+// reverse-mode back-propagation.
+//
+// For any upstream vector u, the dot product of u with
+// the tangent must equal the dot product of the gradient
+// (computed with u as upstream) with the variable
+// tangents.
+func TestApplyDual(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	const inSize = 3
+	const outSize = 2
+	in := dualTestBatches(c, inSize, 2, 3, 0, 1)
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	params := anynet.AllParameters(block)
+	tangents := randomTangents(append(batchVars(in), params...)...)
+	paramTangents := lazyseq.Tangents{}
+	for _, p := range params {
+		paramTangents[p] = tangents[p]
+	}
+
+	strategies := map[string]lazyrnn.Strategy{
+		"BPTT": lazyrnn.BPTTStrategy,
+		"HSM":  lazyrnn.HSMStrategy(2, 2, true),
+	}
+	for name, strategy := range strategies {
+		t.Run(name+"Vars", func(t *testing.T) {
+			testDualEquivalent(t, tangents, func() lazyseq.DualSeq {
+				return lazyrnn.ApplyDual(strategy, lazyseq.Lazify(anyseq.ResSeq(c, in)),
+					nil, block, tangents)
+			}, func() anyseq.Seq {
+				return anyrnn.Map(anyseq.ResSeq(c, in), block)
+			})
+		})
+		t.Run(name+"InTangent", func(t *testing.T) {
+			testDualEquivalent(t, tangents, func() lazyseq.DualSeq {
+				inTangent := lazyseq.Lazify(tangentSeq(c, in, tangents))
+				return lazyrnn.ApplyDual(strategy, lazyseq.Lazify(anyseq.ResSeq(c, in)),
+					inTangent, block, paramTangents)
+			}, func() anyseq.Seq {
+				return anyrnn.Map(anyseq.ResSeq(c, in), block)
+			})
+		})
+	}
+}
+
+func testDualEquivalent(t *testing.T, tangents map[*anydiff.Var]anyvec.Vector,
+	actual func() lazyseq.DualSeq, expected func() anyseq.Seq) {
+	var actBatches []*lazyseq.DualBatch
+	for batch := range actual().Forward() {
+		actBatches = append(actBatches, batch)
+	}
+
+	expSeq := expected()
+	expOut := expSeq.Output()
+	if len(actBatches) != len(expOut) {
+		t.Fatalf("expected %d timesteps but got %d", len(expOut), len(actBatches))
+	}
+	for i, batch := range actBatches {
+		if !vectorsClose(batch.Packed, expOut[i].Packed, 1e-4) {
+			t.Fatalf("time %d: expected output %v but got %v", i,
+				expOut[i].Packed.Data(), batch.Packed.Data())
+		}
+	}
+
+	var vars []*anydiff.Var
+	for v := range tangents {
+		vars = append(vars, v)
+	}
+	for trial := 0; trial < 3; trial++ {
+		var upstream []*anyseq.Batch
+		var actDot float64
+		for i, batch := range actBatches {
+			u := randomVector(expSeq.Creator(), batch.Packed.Len())
+			actDot += u.Dot(batch.Tangent).(float64)
+			upstream = append(upstream, &anyseq.Batch{
+				Packed:  u,
+				Present: expOut[i].Present,
+			})
+		}
+		grad := anydiff.NewGrad(vars...)
+		expSeq.Propagate(upstream, grad)
+		if expDot := tangentDot(grad, tangents); !dotsClose(actDot, expDot) {
+			t.Errorf("trial %d: expected u*J*t=%f but got %f", trial, expDot, actDot)
+		}
+	}
+}
+
+func tangentDot(grad anydiff.Grad, tangents map[*anydiff.Var]anyvec.Vector) float64 {
+	var res float64
+	for v, tangent := range tangents {
+		if g, ok := grad[v]; ok {
+			res += g.Dot(tangent).(float64)
+		}
+	}
+	return res
+}
+
+func dotsClose(actual, expected float64) bool {
+	return math.Abs(actual-expected) <= 1e-6*math.Max(1, math.Abs(expected))
+}
+
+// dualTestBatches generates batches of random variables,
+// like testSeqsLen.
+func dualTestBatches(c anyvec.Creator, inSize int, lengths ...int) []*anyseq.ResBatch {
+	var res []*anyseq.ResBatch
+	for _, batch := range testSeqsLen(c, inSize, lengths...).Output() {
+		res = append(res, &anyseq.ResBatch{
+			Packed:  anydiff.NewVar(batch.Packed),
+			Present: batch.Present,
+		})
+	}
+	return res
+}
+
+func batchVars(batches []*anyseq.ResBatch) []*anydiff.Var {
+	var res []*anydiff.Var
+	for _, batch := range batches {
+		res = append(res, batch.Packed.(*anydiff.Var))
+	}
+	return res
+}
+
+// tangentSeq creates a sequence containing the tangents
+// for the variables in some batches.
+func tangentSeq(c anyvec.Creator, batches []*anyseq.ResBatch,
+	tangents map[*anydiff.Var]anyvec.Vector) anyseq.Seq {
+	var res []*anyseq.ResBatch
+	for _, batch := range batches {
+		res = append(res, &anyseq.ResBatch{
+			Packed:  anydiff.NewConst(tangents[batch.Packed.(*anydiff.Var)]),
+			Present: batch.Present,
+		})
+	}
+	return anyseq.ResSeq(c, res)
+}
+
+func randomTangents(vars ...*anydiff.Var) map[*anydiff.Var]anyvec.Vector {
+	res := map[*anydiff.Var]anyvec.Vector{}
+	for _, v := range vars {
+		res[v] = randomVector(v.Vector.Creator(), v.Vector.Len())
+	}
+	return res
+}
+
+func randomVector(c anyvec.Creator, size int) anyvec.Vector {
+	data := make([]float64, size)
+	for i := range data {
+		data[i] = rand.NormFloat64()
+	}
+	return c.MakeVectorData(c.MakeNumericList(data))
+}
+
+func vectorsClose(v1, v2 anyvec.Vector, tol float64) bool {
+	if v1.Len() != v2.Len() {
+		return false
+	}
+	diff := v1.Copy()
+	diff.Sub(v2)
+	return v1.Len() == 0 || anyvec.AbsMax(diff).(float64) <= tol
+}
+
+// scanDualBlock is a DualBlock which computes
+// h' = tanh(w*h + x), where w is a vector of
+// per-component weights.
+type scanDualBlock struct {
+	Weights        *anydiff.Var
+	WeightsTangent anyvec.Vector
+}
+
+func (s *scanDualBlock) StartDual(n int) *lazyrnn.DualState {
+	c := s.Weights.Vector.Creator()
+	present := make(anyrnn.PresentMap, n)
+	for i := range present {
+		present[i] = true
+	}
+	size := n * s.Weights.Vector.Len()
+	return &lazyrnn.DualState{
+		State:   &vecState{Vector: c.MakeVector(size), PresentMap: present},
+		Tangent: &vecState{Vector: c.MakeVector(size), PresentMap: present},
+	}
+}
+
+func (s *scanDualBlock) StepDual(state *lazyrnn.DualState, in,
+	inTangent anyvec.Vector) *lazyrnn.DualStepResult {
+	w := anydiff.NewConst(s.Weights.Vector)
+	h := anydiff.NewConst(state.State.(*vecState).Vector)
+	dh := anydiff.NewConst(state.Tangent.(*vecState).Vector)
+
+	out := anydiff.Tanh(anydiff.Add(anydiff.ScaleRepeated(h, w), anydiff.NewConst(in)))
+	dPre := anydiff.Add(
+		anydiff.Add(anydiff.ScaleRepeated(dh, w),
+			anydiff.ScaleRepeated(h, anydiff.NewConst(s.WeightsTangent))),
+		anydiff.NewConst(inTangent),
+	)
+	dOut := anydiff.Sub(dPre, anydiff.Mul(anydiff.Mul(out, out), dPre))
+
+	present := state.State.Present()
+	return &lazyrnn.DualStepResult{
+		Output:        out.Output(),
+		OutputTangent: dOut.Output(),
+		State: &lazyrnn.DualState{
+			State:   &vecState{Vector: out.Output(), PresentMap: present},
+			Tangent: &vecState{Vector: dOut.Output(), PresentMap: present},
+		},
+	}
+}
+
+type vecState struct {
+	Vector     anyvec.Vector
+	PresentMap anyrnn.PresentMap
+}
+
+func (v *vecState) Present() anyrnn.PresentMap {
+	return v.PresentMap
+}
+
+func (v *vecState) Reduce(p anyrnn.PresentMap) anyrnn.State {
+	batch := &anyseq.Batch{Packed: v.Vector, Present: v.PresentMap}
+	return &vecState{Vector: batch.Reduce(p).Packed, PresentMap: p}
+}
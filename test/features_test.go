@@ -0,0 +1,60 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestConcatFeatures(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, 3, 1, 7, 0, 3, 3),
+		testSeqsLen(c, 2, 1, 7, 0, 3, 3),
+	}
+	block := anyrnn.NewLSTM(c, 5, 2)
+
+	testEquivalent(t, func() anyseq.Seq {
+		var lazySeqs []lazyseq.Rereader
+		for _, s := range seqs {
+			lazySeqs = append(lazySeqs, lazyseq.Lazify(s))
+		}
+		joined := lazyseq.ConcatFeatures(lazySeqs...)
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(3, true, joined, block))
+	}, func() anyseq.Seq {
+		joined := anyseq.MapN(func(n int, v ...anydiff.Res) anydiff.Res {
+			var rows []anydiff.Res
+			for i := 0; i < n; i++ {
+				rows = append(rows, anydiff.Slice(v[0], i*3, (i+1)*3),
+					anydiff.Slice(v[1], i*2, (i+1)*2))
+			}
+			return anydiff.Concat(rows...)
+		}, seqs...)
+		return anyrnn.Map(joined, block)
+	})
+}
+
+func TestSplitFeatures(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, 5, 1, 7, 0, 3, 3)
+
+	testEquivalent(t, func() anyseq.Seq {
+		pieces := lazyseq.SplitFeatures(lazyseq.Lazify(inSeqs), 2, 0, 3)
+		return lazyseq.Unlazify(lazyseq.ConcatFeatures(pieces[2], pieces[1],
+			pieces[0]))
+	}, func() anyseq.Seq {
+		return anyseq.Map(inSeqs, func(v anydiff.Res, n int) anydiff.Res {
+			var rows []anydiff.Res
+			for i := 0; i < n; i++ {
+				rows = append(rows, anydiff.Slice(v, i*5+2, (i+1)*5),
+					anydiff.Slice(v, i*5, i*5+2))
+			}
+			return anydiff.Concat(rows...)
+		})
+	})
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestCustomStrategy(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+	inSeqs := testSeqs(c, inSize)
+
+	actualFunc := func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyrnn.ApplyStrategy(recomputeStrategy,
+			lazyseq.Lazify(inSeqs), block))
+	}
+	expectedFunc := func() anyseq.Seq {
+		return anyrnn.Map(inSeqs, block)
+	}
+	testEquivalent(t, actualFunc, expectedFunc)
+}
+
+// recomputeStrategy is a lazyrnn.Strategy which stores
+// nothing during the forward pass and re-computes the
+// entire sequence during back-propagation.
+func recomputeStrategy(in *lazyrnn.RereaderFragment, b anyrnn.Block,
+	start anyrnn.State) lazyrnn.Fragment {
+	out := make(chan *anyseq.Batch, 1)
+	done := make(chan struct{})
+	res := &recomputeFrag{
+		In:    in,
+		Block: b,
+		Start: start,
+		Out:   out,
+		Done:  done,
+		V:     anydiff.VarSet{},
+	}
+	go func() {
+		state := start
+		for batch := range in.Forward {
+			if state == nil {
+				state = b.Start(len(batch.Present))
+			}
+			if state.Present().NumPresent() != batch.NumPresent() {
+				state = state.Reduce(batch.Present)
+			}
+			stepRes := b.Step(state, batch.Packed)
+			res.V = anydiff.MergeVarSets(res.V, stepRes.Vars())
+			res.Len++
+			state = stepRes.State()
+			out <- &anyseq.Batch{Present: batch.Present, Packed: stepRes.Output()}
+		}
+		close(done)
+		close(out)
+	}()
+	return res
+}
+
+type recomputeFrag struct {
+	In    *lazyrnn.RereaderFragment
+	Block anyrnn.Block
+	Start anyrnn.State
+	Out   <-chan *anyseq.Batch
+
+	Done <-chan struct{}
+	Len  int
+	V    anydiff.VarSet
+}
+
+func (r *recomputeFrag) Forward() <-chan *anyseq.Batch {
+	return r.Out
+}
+
+func (r *recomputeFrag) Vars() anydiff.VarSet {
+	<-r.Done
+	return r.V
+}
+
+func (r *recomputeFrag) Propagate(down chan<- *anyseq.Batch, up <-chan *anyseq.Batch,
+	stateUp anyrnn.StateGrad, grad lazyseq.Grad) anyrnn.StateGrad {
+	for _ = range r.Out {
+	}
+	frag := lazyrnn.BPTTFragment(r.In.Offset, r.In.Slice(0, r.Len).Forward, r.Block, r.Start)
+	return frag.Propagate(down, up, stateUp, grad)
+}
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestLocalGrad(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 1, 0, 5),
+		testSeqsLen(c, inSize, 7, 1),
+		testSeqsLen(c, inSize, 3, 4, 1, 3),
+	}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	makeSeq := func() lazyseq.Seq {
+		var lazySeqs []lazyseq.Seq
+		for _, s := range seqs {
+			lazySeqs = append(lazySeqs, lazyrnn.BPTT(lazyseq.Lazify(s), block))
+		}
+		return lazyseq.PackSeq(c, lazySeqs)
+	}
+
+	expected := computeGradient(lazyseq.Unlazify(makeSeq()), nil)
+
+	seq := makeSeq()
+	var outs []*anyseq.Batch
+	for batch := range seq.Forward() {
+		outs = append(outs, batch)
+	}
+	actual := anydiff.NewGrad(seq.Vars().Slice()...)
+	localGrad := lazyseq.NewLocalGrad(actual)
+
+	// Use the same upstream as computeGradient by way of
+	// an equivalent anyseq.Seq.
+	upstream := make(chan *anyseq.Batch, len(outs))
+	recorder := &upstreamRecorder{Batches: outs}
+	computeGradient(recorder, anydiff.VarSet{})
+	for i := len(recorder.Upstream) - 1; i >= 0; i-- {
+		upstream <- recorder.Upstream[i]
+	}
+	close(upstream)
+	seq.Propagate(upstream, localGrad)
+	localGrad.Flush()
+
+	gradientsEquivalent(t, actual, expected)
+}
+
+func TestLocalGradConcurrent(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	v := anydiff.NewVar(c.MakeVector(10))
+	grad := anydiff.NewGrad(v)
+	localGrad := lazyseq.NewLocalGrad(grad)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				localGrad.Use(func(g anydiff.Grad) {
+					g[v].AddScalar(c.MakeNumeric(1))
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	localGrad.Flush()
+
+	for i, x := range grad[v].Data().([]float64) {
+		if x != 1000 {
+			t.Errorf("component %d: expected 1000 but got %f", i, x)
+		}
+	}
+}
+
+func BenchmarkMutexGrad(b *testing.B) {
+	benchmarkGrad(b, func(g anydiff.Grad) lazyseq.Grad {
+		return lazyseq.NewGrad(g)
+	}, func(g lazyseq.Grad) {})
+}
+
+func BenchmarkLocalGrad(b *testing.B) {
+	benchmarkGrad(b, func(g anydiff.Grad) lazyseq.Grad {
+		return lazyseq.NewLocalGrad(g)
+	}, func(g lazyseq.Grad) {
+		g.(*lazyseq.LocalGrad).Flush()
+	})
+}
+
+func benchmarkGrad(b *testing.B, makeGrad func(g anydiff.Grad) lazyseq.Grad,
+	flush func(g lazyseq.Grad)) {
+	const numGoroutines = 8
+	c := anyvec64.DefaultCreator{}
+	v := anydiff.NewVar(c.MakeVector(256 * 256))
+	in := anydiff.NewConst(c.MakeVector(256 * 256))
+	anyvec.Rand(in.Vector, anyvec.Normal, nil)
+	res := anydiff.Tanh(anydiff.Mul(v, in))
+	upstream := c.MakeVector(256 * 256)
+	anyvec.Rand(upstream, anyvec.Normal, nil)
+
+	grad := makeGrad(anydiff.NewGrad(v))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < numGoroutines; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				grad.Use(func(g anydiff.Grad) {
+					res.Propagate(upstream.Copy(), g)
+				})
+			}()
+		}
+		wg.Wait()
+		flush(grad)
+	}
+}
+
+// upstreamRecorder is an anyseq.Seq which records the
+// upstream batches passed to Propagate.
+type upstreamRecorder struct {
+	Batches  []*anyseq.Batch
+	Upstream []*anyseq.Batch
+}
+
+func (u *upstreamRecorder) Creator() anyvec.Creator {
+	return u.Batches[0].Packed.Creator()
+}
+
+func (u *upstreamRecorder) Output() []*anyseq.Batch {
+	return u.Batches
+}
+
+func (u *upstreamRecorder) Vars() anydiff.VarSet {
+	return anydiff.VarSet{}
+}
+
+func (u *upstreamRecorder) Propagate(upstream []*anyseq.Batch, g anydiff.Grad) {
+	u.Upstream = upstream
+}
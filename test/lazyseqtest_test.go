@@ -0,0 +1,158 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyseqtest"
+)
+
+func TestLazySeqTestHarness(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	in := dualTestBatches(c, 3, 2, 3, 0, 1)
+	scaler := anydiff.NewVar(c.MakeVector(3))
+	anyvec.Rand(scaler.Vector, anyvec.Normal, nil)
+
+	rereaders := map[string]func() lazyseq.Rereader{
+		"Lazify": func() lazyseq.Rereader {
+			return lazyseq.Lazify(anyseq.ResSeq(c, in))
+		},
+		"Map": func() lazyseq.Rereader {
+			return lazyseq.Map(lazyseq.Lazify(anyseq.ResSeq(c, in)),
+				func(v anydiff.Res, n int) anydiff.Res {
+					return anydiff.Tanh(anydiff.ScaleRepeated(v, scaler))
+				})
+		},
+		"Reverse": func() lazyseq.Rereader {
+			return lazyseq.Reverse(lazyseq.Lazify(anyseq.ResSeq(c, in)))
+		},
+		"Slice": func() lazyseq.Rereader {
+			return lazyseq.Slice(lazyseq.Lazify(anyseq.ResSeq(c, in)), 1, 3)
+		},
+	}
+	seqs := map[string]func() lazyseq.Seq{
+		"CumSum": func() lazyseq.Seq {
+			return lazyseq.CumSum(lazyseq.Lazify(anyseq.ResSeq(c, in)))
+		},
+	}
+	for name, makeRereader := range rereaders {
+		makeRereader := makeRereader
+		seqs[name] = func() lazyseq.Seq {
+			return makeRereader()
+		}
+		t.Run(name+"/Rereader", func(t *testing.T) {
+			lazyseqtest.CheckRereader(t, makeRereader)
+		})
+	}
+	for name, makeSeq := range seqs {
+		t.Run(name+"/Seq", func(t *testing.T) {
+			lazyseqtest.CheckSeq(t, makeSeq)
+		})
+		t.Run(name+"/Gradients", func(t *testing.T) {
+			lazyseqtest.CheckGradients(t, makeSeq, nil, 1e-5, 1e-4)
+		})
+	}
+}
+
+func TestLazySeqTestFailures(t *testing.T) {
+	oldTimeout := lazyseqtest.Timeout
+	lazyseqtest.Timeout = time.Millisecond * 100
+	defer func() {
+		lazyseqtest.Timeout = oldTimeout
+	}()
+
+	c := anyvec64.DefaultCreator{}
+	in := dualTestBatches(c, 3, 2, 3, 0, 1)
+	scaler := anydiff.NewVar(c.MakeVector(3))
+	anyvec.Rand(scaler.Vector, anyvec.Normal, nil)
+
+	t.Run("Vars", func(t *testing.T) {
+		recorder := &errorRecorder{}
+		lazyseqtest.CheckSeq(recorder, func() lazyseq.Seq {
+			return &lateVarsSeq{
+				Seq:          lazyseq.Lazify(anyseq.ResSeq(c, in)),
+				UpstreamRead: make(chan struct{}),
+			}
+		})
+		if len(recorder.Errors) == 0 {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("Reread", func(t *testing.T) {
+		recorder := &errorRecorder{}
+		lazyseqtest.CheckRereader(recorder, func() lazyseq.Rereader {
+			return &shiftedRereader{lazyseq.Lazify(anyseq.ResSeq(c, in))}
+		})
+		if len(recorder.Errors) == 0 {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("Gradients", func(t *testing.T) {
+		recorder := &errorRecorder{}
+		lazyseqtest.CheckGradients(recorder, func() lazyseq.Seq {
+			return lazyseq.Map(lazyseq.Lazify(anyseq.ResSeq(c, in)),
+				func(v anydiff.Res, n int) anydiff.Res {
+					// The gradient with respect to scaler is
+					// discarded by the Const.
+					return anydiff.ScaleRepeated(v, anydiff.NewConst(scaler.Vector))
+				})
+		}, []*anydiff.Var{scaler}, 1e-5, 1e-4)
+		if len(recorder.Errors) == 0 {
+			t.Error("expected an error")
+		}
+	})
+}
+
+type errorRecorder struct {
+	Errors []string
+}
+
+func (e *errorRecorder) Errorf(format string, args ...interface{}) {
+	e.Errors = append(e.Errors, fmt.Sprintf(format, args...))
+}
+
+// lateVarsSeq breaks the protocol by blocking Vars()
+// until Propagate() has read an upstream batch.
+type lateVarsSeq struct {
+	lazyseq.Seq
+	UpstreamRead chan struct{}
+}
+
+func (l *lateVarsSeq) Vars() anydiff.VarSet {
+	<-l.UpstreamRead
+	return l.Seq.Vars()
+}
+
+func (l *lateVarsSeq) Propagate(upstream <-chan *anyseq.Batch, grad lazyseq.Grad) {
+	inner := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range upstream {
+			select {
+			case <-l.UpstreamRead:
+			default:
+				close(l.UpstreamRead)
+			}
+			inner <- batch
+		}
+		close(inner)
+	}()
+	l.Seq.Propagate(inner, grad)
+}
+
+// shiftedRereader breaks the protocol by always rereading
+// from the first timestep.
+type shiftedRereader struct {
+	lazyseq.Rereader
+}
+
+func (s *shiftedRereader) Reread(start, end int) <-chan *anyseq.Batch {
+	return s.Rereader.Reread(0, end-start)
+}
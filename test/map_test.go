@@ -1,7 +1,9 @@
 package test
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anydiff/anyseq"
@@ -80,3 +82,265 @@ func TestMapNReread(t *testing.T) {
 		return anyrnn.Map(seq, block)
 	})
 }
+
+func TestMapNIndexed(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	const inSize = 3
+	const outSize = 2
+
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 1, 7, 0, 3, 3),
+		testSeqsLen(c, inSize, 1, 7, 0, 3, 3),
+	}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	f := func(t int, present []bool, reses ...anydiff.Res) anydiff.Res {
+		scale := float64(t + 1)
+		if present[0] {
+			scale += 10
+		}
+		return anydiff.Scale(
+			anydiff.Sub(reses[0], reses[1]),
+			reses[0].Output().Creator().MakeNumeric(scale),
+		)
+	}
+	expected := func() anyseq.Seq {
+		var timestep int
+		return anyseq.MapN(func(n int, reses ...anydiff.Res) anydiff.Res {
+			present := seqs[0].Output()[timestep].Present
+			res := f(timestep, present, reses...)
+			timestep++
+			return res
+		}, seqs...)
+	}
+
+	lazyMapped := func() lazyseq.Rereader {
+		var lazySeqs []lazyseq.Rereader
+		for _, s := range seqs {
+			lazySeqs = append(lazySeqs, lazyseq.Lazify(s))
+		}
+		return lazyseq.MapNIndexed(f, lazySeqs...)
+	}
+
+	testEquivalent(t, func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyMapped())
+	}, expected)
+
+	testEquivalent(t, func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(3, true, lazyMapped(), block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(expected(), block)
+	})
+}
+
+func TestMapNWith(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	const inSize = 3
+	const outSize = 2
+
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 1, 7, 0, 3, 3),
+		testSeqsLen(c, inSize, 1, 7, 0, 3, 3),
+	}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	otherVar := anydiff.NewVar(c.MakeVector(1))
+	anyvec.Rand(otherVar.Vector, anyvec.Normal, nil)
+
+	var numCalls int
+	f := func(n int, reses ...anydiff.Res) anydiff.Res {
+		numCalls++
+		return anydiff.ScaleRepeated(anydiff.Sub(reses[0], reses[1]), otherVar)
+	}
+
+	makeOpts := map[string]func() lazyseq.MapOptions{
+		"Memory": func() lazyseq.MapOptions {
+			return lazyseq.MapOptions{StoreOutputs: true}
+		},
+		"Tape": func() lazyseq.MapOptions {
+			tape, writer := lazyseq.ReferenceTape(c)
+			return lazyseq.MapOptions{Tape: tape, TapeWriter: writer}
+		},
+		"Graph": func() lazyseq.MapOptions {
+			return lazyseq.MapOptions{KeepGraph: true}
+		},
+	}
+
+	for name, makeOpt := range makeOpts {
+		t.Run(name, func(t *testing.T) {
+			lazyMapped := func() lazyseq.Rereader {
+				var lazySeqs []lazyseq.Rereader
+				for _, s := range seqs {
+					lazySeqs = append(lazySeqs, lazyseq.Lazify(s))
+				}
+				return lazyseq.MapNWith(makeOpt(),
+					func(step int, present []bool, v ...anydiff.Res) anydiff.Res {
+						var n int
+						for _, p := range present {
+							if p {
+								n++
+							}
+						}
+						return f(n, v...)
+					}, lazySeqs...)
+			}
+
+			testEquivalent(t, func() anyseq.Seq {
+				return lazyseq.Unlazify(lazyrnn.FixedHSM(3, true, lazyMapped(), block))
+			}, func() anyseq.Seq {
+				return anyrnn.Map(anyseq.MapN(f, seqs...), block)
+			})
+
+			numCalls = 0
+			seq := lazyseq.Unlazify(lazyrnn.FixedHSM(3, true, lazyMapped(), block))
+			var upstream []*anyseq.Batch
+			for _, batch := range seq.Output() {
+				upstream = append(upstream, &anyseq.Batch{
+					Present: batch.Present,
+					Packed:  batch.Packed.Copy(),
+				})
+			}
+			seq.Propagate(upstream, anydiff.NewGrad(otherVar))
+
+			expectedCalls := len(seqs[0].Output())
+			if name != "Graph" {
+				// Propagate still recomputes each timestep.
+				expectedCalls *= 2
+			}
+			if numCalls != expectedCalls {
+				t.Errorf("expected %d calls but got %d", expectedCalls, numCalls)
+			}
+		})
+	}
+}
+
+func TestMapNWorkers(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	const inSize = 3
+	const outSize = 2
+	const numSteps = 7
+	const workers = 4
+
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 1, numSteps, 0, 3, 3, 5),
+		testSeqsLen(c, inSize, 1, numSteps, 0, 3, 3, 5),
+	}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	otherVar := anydiff.NewVar(c.MakeVector(1))
+	anyvec.Rand(otherVar.Vector, anyvec.Normal, nil)
+
+	f := func(n int, reses ...anydiff.Res) anydiff.Res {
+		return anydiff.Scale(
+			anydiff.ScaleRepeated(anydiff.Sub(reses[0], reses[1]), otherVar),
+			c.MakeNumeric(float64(n)),
+		)
+	}
+
+	var lock sync.Mutex
+	var active, maxActive int
+	indexedF := func(step int, present []bool, v ...anydiff.Res) anydiff.Res {
+		lock.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		lock.Unlock()
+
+		// Earlier timesteps take longer, so that later
+		// timesteps finish first.
+		time.Sleep(time.Millisecond * time.Duration(5*(numSteps-step)))
+
+		lock.Lock()
+		active--
+		lock.Unlock()
+
+		var n int
+		for _, p := range present {
+			if p {
+				n++
+			}
+		}
+		return f(n, v...)
+	}
+
+	for _, keepGraph := range []bool{false, true} {
+		opts := lazyseq.MapOptions{Workers: workers, KeepGraph: keepGraph}
+		lazyMapped := func() lazyseq.Rereader {
+			var lazySeqs []lazyseq.Rereader
+			for _, s := range seqs {
+				lazySeqs = append(lazySeqs, lazyseq.Lazify(s))
+			}
+			return lazyseq.MapNWith(opts, indexedF, lazySeqs...)
+		}
+
+		lock.Lock()
+		maxActive = 0
+		lock.Unlock()
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyMapped())
+		}, func() anyseq.Seq {
+			return anyseq.MapN(f, seqs...)
+		})
+		lock.Lock()
+		observedMax := maxActive
+		lock.Unlock()
+		if observedMax < 2 {
+			t.Errorf("keepGraph=%v: expected parallel calls but got %d at once",
+				keepGraph, observedMax)
+		} else if observedMax > workers {
+			t.Errorf("keepGraph=%v: expected at most %d calls at once but got %d",
+				keepGraph, workers, observedMax)
+		}
+
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyrnn.FixedHSM(3, true, lazyMapped(), block))
+		}, func() anyseq.Seq {
+			return anyrnn.Map(anyseq.MapN(f, seqs...), block)
+		})
+	}
+}
+
+func TestMapOptionsValidation(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	seq := testSeqsLen(c, 3, 2, 1)
+	f := func(v anydiff.Res, n int) anydiff.Res {
+		return v
+	}
+
+	invalid := map[string]func() lazyseq.MapOptions{
+		"TapeOnly": func() lazyseq.MapOptions {
+			tape, _ := lazyseq.ReferenceTape(c)
+			return lazyseq.MapOptions{Tape: tape}
+		},
+		"WriterOnly": func() lazyseq.MapOptions {
+			_, writer := lazyseq.ReferenceTape(c)
+			return lazyseq.MapOptions{TapeWriter: writer}
+		},
+		"TapeAndGraph": func() lazyseq.MapOptions {
+			tape, writer := lazyseq.ReferenceTape(c)
+			return lazyseq.MapOptions{Tape: tape, TapeWriter: writer, KeepGraph: true}
+		},
+		"TapeAndMemory": func() lazyseq.MapOptions {
+			tape, writer := lazyseq.ReferenceTape(c)
+			return lazyseq.MapOptions{Tape: tape, TapeWriter: writer, StoreOutputs: true}
+		},
+		"MemoryAndGraph": func() lazyseq.MapOptions {
+			return lazyseq.MapOptions{StoreOutputs: true, KeepGraph: true}
+		},
+		"NegativeWorkers": func() lazyseq.MapOptions {
+			return lazyseq.MapOptions{Workers: -1}
+		},
+	}
+
+	for name, makeOpts := range invalid {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			lazyseq.MapWith(makeOpts(), lazyseq.Lazify(seq), f)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestObserveHSM(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	const seqLen = 16
+	const interval = 4
+
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, seqLen, seqLen, seqLen)
+
+	counter := lazyseq.NewCountObserver()
+	peak := &lazyseq.PeakObserver{}
+	rereads := lazyseq.NewCountObserver()
+
+	block := lazyrnn.Observe(anyrnn.NewLSTM(c, inSize, outSize),
+		lazyseq.MultiObserver{counter, peak})
+	in := lazyseq.Observe(lazyseq.Lazify(inSeqs), rereads)
+	out := lazyseq.Unlazify(lazyrnn.FixedHSM(interval, false, in, block))
+	out.Propagate(out.Output(), anydiff.NewGrad(anynet.AllParameters(block)...))
+
+	expected := lazyrnn.FixedHSMCost(seqLen, interval, false)
+	if n := counter.Count(lazyseq.StepEvent); n != expected.Steps {
+		t.Errorf("expected %d steps but got %d", expected.Steps, n)
+	}
+	for i := 0; i < seqLen; i++ {
+		if n := counter.CountAt(lazyseq.StepEvent, i); n != 2 {
+			t.Errorf("timestep %d: expected 2 steps but got %d", i, n)
+		}
+	}
+	if n := peak.Peak(); n != expected.PeakStates {
+		t.Errorf("expected peak of %d states but got %d", expected.PeakStates, n)
+	}
+	if n := peak.Live(); n != seqLen/interval {
+		t.Errorf("expected %d live states but got %d", seqLen/interval, n)
+	}
+	if n := rereads.Count(lazyseq.RereadEvent); n != seqLen/interval {
+		t.Errorf("expected %d rereads but got %d", seqLen/interval, n)
+	}
+	if n := rereads.Count(lazyseq.BatchEvent); n != seqLen*2 {
+		t.Errorf("expected %d batches but got %d", seqLen*2, n)
+	}
+}
+
+func TestObserveEquiv(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqs(c, inSize)
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	testEquivalent(t, func() anyseq.Seq {
+		obs := lazyseq.NewCountObserver()
+		in := lazyseq.Observe(lazyseq.Lazify(inSeqs), obs)
+		return lazyseq.Unlazify(lazyrnn.RecursiveHSM(2, 2, true, in,
+			lazyrnn.Observe(block, obs)))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(inSeqs, block)
+	})
+}
+
+func TestObserveBPTTFragment(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	const seqLen = 4
+	const offset = 5
+
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, seqLen, seqLen)
+
+	counter := lazyseq.NewCountObserver()
+	block := lazyrnn.Observe(anyrnn.NewLSTM(c, inSize, outSize), counter)
+	frag := lazyrnn.BPTTFragment(offset, lazyseq.Lazify(inSeqs).Forward(), block, nil)
+	for _ = range frag.Forward() {
+	}
+
+	if n := counter.Count(lazyseq.StepEvent); n != seqLen {
+		t.Errorf("expected %d steps but got %d", seqLen, n)
+	}
+	for i := offset; i < offset+seqLen; i++ {
+		if n := counter.CountAt(lazyseq.StepEvent, i); n != 1 {
+			t.Errorf("timestep %d: expected 1 step but got %d", i, n)
+		}
+		if n := counter.CountAt(lazyseq.SaveStateEvent, i); n != 1 {
+			t.Errorf("timestep %d: expected 1 saved state but got %d", i, n)
+		}
+	}
+}
+
+func TestCountObserverZero(t *testing.T) {
+	var counter lazyseq.CountObserver
+	if n := counter.Count(lazyseq.StepEvent); n != 0 {
+		t.Errorf("expected 0 steps but got %d", n)
+	}
+	counter.Observe(lazyseq.StepEvent, 3)
+	counter.Observe(lazyseq.StepEvent, 3)
+	if n := counter.CountAt(lazyseq.StepEvent, 3); n != 2 {
+		t.Errorf("expected 2 steps but got %d", n)
+	}
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestPermuteLanes(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 5)
+	perm := []int{3, 0, 4, 2, 1}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	testEquivalent(t, func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyseq.PermuteLanes(lazyseq.Lazify(inSeqs), perm))
+	}, func() anyseq.Seq {
+		return &permutedSeq{Seq: inSeqs, Perm: perm}
+	})
+
+	testEquivalent(t, func() anyseq.Seq {
+		permuted := lazyseq.PermuteLanes(lazyseq.Lazify(inSeqs), perm)
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(2, true, permuted, block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(&permutedSeq{Seq: inSeqs, Perm: perm}, block)
+	})
+}
+
+func TestLengthDescendingPerm(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	tape, writer := lazyseq.ReferenceTape(c)
+	for _, batch := range testSeqsLen(c, 2, 2, 7, 0, 3, 7).Output() {
+		writer <- batch
+	}
+	close(writer)
+
+	actual := lazyseq.LengthDescendingPerm(tape)
+	expected := []int{1, 4, 3, 0, 2}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+}
+
+// permutedSeq is an anyseq.Seq which reorders the lanes
+// of another anyseq.Seq.
+type permutedSeq struct {
+	anyseq.Seq
+	Perm []int
+}
+
+func (p *permutedSeq) Output() []*anyseq.Batch {
+	return permuteBatches(p.Seq.Creator(), p.Seq.Output(), p.Perm)
+}
+
+func (p *permutedSeq) Propagate(u []*anyseq.Batch, g anydiff.Grad) {
+	inv := make([]int, len(p.Perm))
+	for i, src := range p.Perm {
+		inv[src] = i
+	}
+	p.Seq.Propagate(permuteBatches(p.Seq.Creator(), u, inv), g)
+}
+
+func permuteBatches(c anyvec.Creator, batches []*anyseq.Batch,
+	perm []int) []*anyseq.Batch {
+	var res []*anyseq.Batch
+	for _, batch := range batches {
+		vecSize := batch.Packed.Len() / batch.NumPresent()
+		newBatch := &anyseq.Batch{Present: make([]bool, len(perm))}
+		var rows []anyvec.Vector
+		for i, src := range perm {
+			if !batch.Present[src] {
+				continue
+			}
+			newBatch.Present[i] = true
+			var idx int
+			for _, p := range batch.Present[:src] {
+				if p {
+					idx++
+				}
+			}
+			rows = append(rows, batch.Packed.Slice(idx*vecSize, (idx+1)*vecSize))
+		}
+		newBatch.Packed = c.Concat(rows...)
+		res = append(res, newBatch)
+	}
+	return res
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestHSMCost(t *testing.T) {
+	costs := []lazyrnn.Cost{
+		lazyrnn.BPTTCost(16),
+		lazyrnn.FixedHSMCost(16, 4, false),
+		lazyrnn.RecursiveHSMCost(8, 4, 2, true),
+	}
+	expected := []lazyrnn.Cost{
+		{PeakStates: 16, PeakInputs: 16, Steps: 16},
+		{PeakStates: 8, PeakInputs: 4, Steps: 32},
+		{PeakStates: 7, PeakInputs: 1, Steps: 32},
+	}
+	for i, actual := range costs {
+		if actual != expected[i] {
+			t.Errorf("cost %d: expected %v but got %v", i, expected[i], actual)
+		}
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	const seqLen = 64
+	if p := lazyrnn.Recommend(seqLen, 8, 1); p != nil {
+		t.Errorf("unexpected plan: %v", p)
+	}
+	if p := lazyrnn.Recommend(seqLen, 8, 1000); p == nil {
+		t.Error("expected a plan")
+	} else if !p.BPTT || p.Cost.Steps != seqLen {
+		t.Errorf("expected BPTT with %d steps but got %v", seqLen, p)
+	}
+	if p := lazyrnn.Recommend(seqLen, 8, seqLen*2-1); p == nil {
+		t.Error("expected a plan")
+	} else if p.BPTT {
+		t.Error("BPTT does not fit in the budget")
+	} else if p.Cost.Steps != seqLen*2 {
+		t.Errorf("expected %d steps but got %d", seqLen*2, p.Cost.Steps)
+	}
+	plans := lazyrnn.Plans(seqLen, 8)
+	if p := lazyrnn.RecommendFrom(plans, 100); p == nil {
+		t.Error("expected a plan")
+	} else if !containsPlan(plans, p) {
+		t.Error("recommended plan is not in the list")
+	}
+	lastSteps := -1
+	for memory := 2; memory < seqLen*2; memory++ {
+		p := lazyrnn.Recommend(seqLen, 8, memory)
+		if p == nil {
+			continue
+		}
+		if p.Cost.Memory() > memory {
+			t.Errorf("memory %d: plan uses %d", memory, p.Cost.Memory())
+		}
+		if lastSteps != -1 && p.Cost.Steps > lastSteps {
+			t.Errorf("memory %d: steps increased from %d to %d", memory,
+				lastSteps, p.Cost.Steps)
+		}
+		lastSteps = p.Cost.Steps
+	}
+}
+
+func containsPlan(plans []*lazyrnn.Plan, p *lazyrnn.Plan) bool {
+	for _, x := range plans {
+		if x == p {
+			return true
+		}
+	}
+	return false
+}
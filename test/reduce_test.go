@@ -3,9 +3,12 @@ package test
 import (
 	"testing"
 
+	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
 	"github.com/unixpickle/anyvec/anyvec64"
 	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
 )
 
 func TestReduceTape(t *testing.T) {
@@ -38,3 +41,76 @@ func TestReduceTape(t *testing.T) {
 	}, out)
 	mustRead(t, nil, out)
 }
+
+func TestReduceSeq(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 5)
+
+	for _, present := range [][]bool{
+		{true, true, true, true, true},
+		{true, false, true, true, false},
+		{false, false, true, false, false},
+	} {
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyseq.ReduceSeq(lazyseq.Lazify(inSeqs), present))
+		}, func() anyseq.Seq {
+			return &reducedSeq{Seq: inSeqs, Mask: present}
+		})
+	}
+}
+
+func TestReduceRereader(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 5)
+	present := []bool{true, false, true, true, false}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	testEquivalent(t, func() anyseq.Seq {
+		reduced := lazyseq.ReduceRereader(lazyseq.Lazify(inSeqs), present)
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(2, true, reduced, block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(&reducedSeq{Seq: inSeqs, Mask: present}, block)
+	})
+}
+
+// reducedSeq is an anyseq.Seq which removes some of the
+// sequences from another anyseq.Seq.
+type reducedSeq struct {
+	anyseq.Seq
+	Mask []bool
+}
+
+func (r *reducedSeq) Output() []*anyseq.Batch {
+	var res []*anyseq.Batch
+	for _, batch := range r.Seq.Output() {
+		pres := make([]bool, len(batch.Present))
+		var any bool
+		for i, p := range batch.Present {
+			pres[i] = p && r.Mask[i]
+			any = any || pres[i]
+		}
+		if !any {
+			break
+		}
+		res = append(res, batch.Reduce(pres))
+	}
+	return res
+}
+
+func (r *reducedSeq) Propagate(u []*anyseq.Batch, g anydiff.Grad) {
+	var fullU []*anyseq.Batch
+	for i, batch := range r.Seq.Output() {
+		if i < len(u) {
+			fullU = append(fullU, u[i].Expand(batch.Present))
+		} else {
+			fullU = append(fullU, &anyseq.Batch{
+				Present: batch.Present,
+				Packed:  batch.Packed.Creator().MakeVector(batch.Packed.Len()),
+			})
+		}
+	}
+	r.Seq.Propagate(fullU, g)
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestDiscountedReturns(t *testing.T) {
+	const gamma = 0.9
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, 1, 2)
+
+	for _, lengths := range [][]int{{2, 7, 0, 3, 5}, {1}, {17, 16, 3}} {
+		rewards := testSeqsLen(c, 1, lengths...)
+		expected := func() anyseq.Seq {
+			return reverseScanSeq(rewards, func(lane int, r []float64, t int,
+				next float64) float64 {
+				return r[t] + gamma*next
+			})
+		}
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyseq.DiscountedReturns(lazyseq.Lazify(rewards),
+				gamma))
+		}, expected)
+		testEquivalent(t, func() anyseq.Seq {
+			returns := lazyseq.DiscountedReturns(lazyseq.Lazify(rewards), gamma)
+			return lazyseq.Unlazify(lazyrnn.FixedHSM(3, true, returns, block))
+		}, func() anyseq.Seq {
+			return anyrnn.Map(expected(), block)
+		})
+	}
+}
+
+func TestGAE(t *testing.T) {
+	const gamma = 0.9
+	const lambda = 0.8
+	c := anyvec64.DefaultCreator{}
+
+	for _, lengths := range [][]int{{2, 7, 0, 3, 5}, {1}, {17, 16, 3}} {
+		rewards := testSeqsLen(c, 1, lengths...)
+		values := testSeqsLen(c, 1, lengths...)
+		valueLists := seqLists(values)
+		expected := reverseScanSeq(rewards, func(lane int, r []float64, t int,
+			next float64) float64 {
+			v := valueLists[lane]
+			delta := r[t] - v[t]
+			if t+1 < len(v) {
+				delta += gamma * v[t+1]
+			}
+			return delta + gamma*lambda*next
+		})
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyseq.GAE(lazyseq.Lazify(rewards),
+				lazyseq.Lazify(values), gamma, lambda))
+		}, func() anyseq.Seq {
+			return expected
+		})
+	}
+}
+
+// reverseScanSeq computes a constant sequence by scanning
+// backwards over each sequence in seq.
+//
+// The step function is called for every timestep of a
+// sequence, from last to first.
+func reverseScanSeq(seq anyseq.Seq,
+	step func(lane int, seq []float64, t int, next float64) float64) anyseq.Seq {
+	c := seq.Creator()
+	var outs [][]anyvec.Vector
+	for laneIdx, lane := range seqLists(seq) {
+		out := make([]anyvec.Vector, len(lane))
+		var next float64
+		for t := len(lane) - 1; t >= 0; t-- {
+			next = step(laneIdx, lane, t, next)
+			out[t] = c.MakeVectorData([]float64{next})
+		}
+		outs = append(outs, out)
+	}
+	return anyseq.ConstSeqList(c, outs)
+}
+
+// seqLists extracts the scalar timesteps of each sequence
+// in seq.
+func seqLists(seq anyseq.Seq) [][]float64 {
+	var res [][]float64
+	for _, batch := range seq.Output() {
+		if res == nil {
+			res = make([][]float64, len(batch.Present))
+		}
+		data := batch.Packed.Data().([]float64)
+		var idx int
+		for lane, pres := range batch.Present {
+			if pres {
+				res[lane] = append(res[lane], data[idx])
+				idx++
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestReverse(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 1, 7, 0, 3, 7, 6)
+
+	testEquivalent(t, func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyseq.Reverse(lazyseq.Lazify(inSeqs)))
+	}, func() anyseq.Seq {
+		return &reversedSeq{Seq: inSeqs}
+	})
+}
+
+func TestReverseReread(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 1, 7, 0, 3, 7, 6)
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	testEquivalent(t, func() anyseq.Seq {
+		reversed := lazyseq.Reverse(lazyseq.Lazify(inSeqs))
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(3, true, reversed, block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(&reversedSeq{Seq: inSeqs}, block)
+	})
+}
+
+// reversedSeq is an anyseq.Seq which reverses each
+// sequence in another anyseq.Seq.
+type reversedSeq struct {
+	anyseq.Seq
+}
+
+func (r *reversedSeq) Output() []*anyseq.Batch {
+	return reverseBatches(r.Seq.Creator(), r.Seq.Output())
+}
+
+func (r *reversedSeq) Propagate(u []*anyseq.Batch, g anydiff.Grad) {
+	r.Seq.Propagate(reverseBatches(r.Seq.Creator(), u), g)
+}
+
+func reverseBatches(c anyvec.Creator, batches []*anyseq.Batch) []*anyseq.Batch {
+	if len(batches) == 0 {
+		return nil
+	}
+	lens := make([]int, len(batches[0].Present))
+	for _, batch := range batches {
+		for lane, pres := range batch.Present {
+			if pres {
+				lens[lane]++
+			}
+		}
+	}
+	var res []*anyseq.Batch
+	for t, batch := range batches {
+		vecSize := batch.Packed.Len() / batch.NumPresent()
+		var rows []anyvec.Vector
+		for lane, pres := range batch.Present {
+			if !pres {
+				continue
+			}
+			src := batches[lens[lane]-(t+1)]
+			var idx int
+			for _, p := range src.Present[:lane] {
+				if p {
+					idx++
+				}
+			}
+			rows = append(rows, src.Packed.Slice(idx*vecSize, (idx+1)*vecSize))
+		}
+		res = append(res, &anyseq.Batch{
+			Present: batch.Present,
+			Packed:  c.Concat(rows...),
+		})
+	}
+	return res
+}
@@ -0,0 +1,192 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestCumSum(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 5)
+
+	testEquivalent(t, func() anyseq.Seq {
+		return lazyseq.Unlazify(lazyseq.CumSum(lazyseq.Lazify(inSeqs)))
+	}, func() anyseq.Seq {
+		return newLaneScanSeq(inSeqs, nil, func(acc, x anydiff.Res) anydiff.Res {
+			return anydiff.Add(acc, x)
+		})
+	})
+}
+
+func TestCumSumScratchUpstream(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 5)
+
+	testEquivalent(t, func() anyseq.Seq {
+		in := &scratchUpstreamSeq{lazyseq.Lazify(inSeqs)}
+		return lazyseq.Unlazify(lazyseq.CumSum(in))
+	}, func() anyseq.Seq {
+		return newLaneScanSeq(inSeqs, nil, func(acc, x anydiff.Res) anydiff.Res {
+			return anydiff.Add(acc, x)
+		})
+	})
+}
+
+func TestScan(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	init := anydiff.NewVar(c.MakeVector(inSize))
+	weights := anydiff.NewVar(c.MakeVector(inSize))
+	anyvec.Rand(init.Vector, anyvec.Normal, nil)
+	anyvec.Rand(weights.Vector, anyvec.Normal, nil)
+	combine := func(acc, x anydiff.Res) anydiff.Res {
+		return anydiff.Tanh(anydiff.Add(anydiff.ScaleRepeated(acc, weights), x))
+	}
+
+	for _, lengths := range [][]int{{2, 7, 0, 3, 5}, {1}, {16, 15, 3}} {
+		inSeqs := testSeqsLen(c, inSize, lengths...)
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyseq.Scan(lazyseq.Lazify(inSeqs), init,
+				func(acc, x anydiff.Res, n int) anydiff.Res {
+					return combine(acc, x)
+				}))
+		}, func() anyseq.Seq {
+			return newLaneScanSeq(inSeqs, init, combine)
+		})
+
+		testEquivalent(t, func() anyseq.Seq {
+			scanned := lazyseq.Scan(lazyseq.Lazify(inSeqs), init,
+				func(acc, x anydiff.Res, n int) anydiff.Res {
+					return combine(acc, x)
+				})
+			return lazyseq.Unlazify(lazyrnn.FixedHSM(3, true, scanned, block))
+		}, func() anyseq.Seq {
+			return anyrnn.Map(newLaneScanSeq(inSeqs, init, combine), block)
+		})
+	}
+}
+
+// laneScanSeq is a reference implementation of a scan,
+// which applies the combine function to one sequence at
+// a time.
+type laneScanSeq struct {
+	In    anyseq.Seq
+	Pools []*anydiff.Var
+	Outs  []anydiff.Res
+	Batch []*anyseq.Batch
+	V     anydiff.VarSet
+}
+
+// newLaneScanSeq creates a laneScanSeq.
+// If init is nil, the first input is used as the first
+// accumulator.
+func newLaneScanSeq(in anyseq.Seq, init anydiff.Res,
+	combine func(acc, x anydiff.Res) anydiff.Res) *laneScanSeq {
+	res := &laneScanSeq{In: in}
+	ins := in.Output()
+	if len(ins) == 0 {
+		res.V = in.Vars()
+		return res
+	}
+	accs := make([]anydiff.Res, len(ins[0].Present))
+	for _, batch := range ins {
+		pool := anydiff.NewVar(batch.Packed)
+		res.Pools = append(res.Pools, pool)
+		vecSize := batch.Packed.Len() / batch.NumPresent()
+		var rows []anydiff.Res
+		var idx int
+		for lane, pres := range batch.Present {
+			if !pres {
+				continue
+			}
+			row := anydiff.Slice(pool, idx*vecSize, (idx+1)*vecSize)
+			idx++
+			if accs[lane] == nil && init == nil {
+				accs[lane] = row
+			} else if accs[lane] == nil {
+				accs[lane] = combine(init, row)
+			} else {
+				accs[lane] = combine(accs[lane], row)
+			}
+			rows = append(rows, accs[lane])
+		}
+		out := anydiff.Concat(rows...)
+		res.Outs = append(res.Outs, out)
+		res.Batch = append(res.Batch, &anyseq.Batch{
+			Present: batch.Present,
+			Packed:  out.Output(),
+		})
+	}
+
+	var vars []*anydiff.Var
+	for _, out := range res.Outs {
+		for v := range out.Vars() {
+			vars = append(vars, v)
+		}
+	}
+	res.V = anydiff.MergeVarSets(in.Vars(), anydiff.NewVarSet(vars...))
+	for _, pool := range res.Pools {
+		res.V.Del(pool)
+	}
+	return res
+}
+
+func (l *laneScanSeq) Creator() anyvec.Creator {
+	return l.In.Creator()
+}
+
+func (l *laneScanSeq) Output() []*anyseq.Batch {
+	return l.Batch
+}
+
+func (l *laneScanSeq) Vars() anydiff.VarSet {
+	return l.V
+}
+
+func (l *laneScanSeq) Propagate(u []*anyseq.Batch, g anydiff.Grad) {
+	for _, pool := range l.Pools {
+		g[pool] = pool.Vector.Creator().MakeVector(pool.Vector.Len())
+	}
+	for t, out := range l.Outs {
+		out.Propagate(u[t].Packed, g)
+	}
+	var downstream []*anyseq.Batch
+	for t, pool := range l.Pools {
+		downstream = append(downstream, &anyseq.Batch{
+			Present: l.Batch[t].Present,
+			Packed:  g[pool],
+		})
+		delete(g, pool)
+	}
+	l.In.Propagate(downstream, g)
+}
+
+// scratchUpstreamSeq uses its upstream vectors as scratch
+// space, as Propagate() is allowed to do.
+type scratchUpstreamSeq struct {
+	lazyseq.Seq
+}
+
+func (s *scratchUpstreamSeq) Propagate(upstream <-chan *anyseq.Batch, grad lazyseq.Grad) {
+	inner := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range upstream {
+			inner <- &anyseq.Batch{Packed: batch.Packed.Copy(), Present: batch.Present}
+			batch.Packed.Scale(batch.Packed.Creator().MakeNumeric(-1337))
+		}
+		close(inner)
+	}()
+	s.Seq.Propagate(inner, grad)
+}
@@ -0,0 +1,83 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestSlice(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 1, 7, 0, 3, 5, 6)
+
+	for _, bounds := range [][2]int{{0, 7}, {2, 5}, {3, -1}, {4, 100}, {7, 8}} {
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyseq.Slice(lazyseq.Lazify(inSeqs),
+				bounds[0], bounds[1]))
+		}, func() anyseq.Seq {
+			return &timeSliceSeq{Seq: inSeqs, Start: bounds[0], End: bounds[1]}
+		})
+	}
+}
+
+func TestSliceReread(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 1, 7, 0, 3, 5, 6)
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	testEquivalent(t, func() anyseq.Seq {
+		sliced := lazyseq.Slice(lazyseq.Lazify(inSeqs), 2, 6)
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(2, true, sliced, block))
+	}, func() anyseq.Seq {
+		return anyrnn.Map(&timeSliceSeq{Seq: inSeqs, Start: 2, End: 6}, block)
+	})
+}
+
+// timeSliceSeq is an anyseq.Seq containing a range of
+// timesteps from another anyseq.Seq.
+type timeSliceSeq struct {
+	anyseq.Seq
+	Start int
+	End   int
+}
+
+func (t *timeSliceSeq) Output() []*anyseq.Batch {
+	start, end := t.bounds()
+	return t.Seq.Output()[start:end]
+}
+
+func (t *timeSliceSeq) Propagate(u []*anyseq.Batch, g anydiff.Grad) {
+	start, end := t.bounds()
+	var fullU []*anyseq.Batch
+	for i, batch := range t.Seq.Output() {
+		if i >= start && i < end {
+			fullU = append(fullU, u[i-start])
+		} else {
+			fullU = append(fullU, &anyseq.Batch{
+				Present: batch.Present,
+				Packed:  batch.Packed.Creator().MakeVector(batch.Packed.Len()),
+			})
+		}
+	}
+	t.Seq.Propagate(fullU, g)
+}
+
+func (t *timeSliceSeq) bounds() (start, end int) {
+	length := len(t.Seq.Output())
+	start, end = t.Start, t.End
+	if end == -1 || end > length {
+		end = length
+	}
+	if start > end {
+		start = end
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+)
+
+func TestTee(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqs(c, inSize)
+
+	actualFunc := func() anydiff.Res {
+		tees := lazyseq.Tee(lazyseq.Lazify(inSeqs), 2)
+		return anydiff.Concat(lazyseq.Tail(tees[0]), lazyseq.Sum(tees[1]))
+	}
+	expectedFunc := func() anydiff.Res {
+		return anydiff.Concat(anyseq.Tail(inSeqs), anyseq.Sum(inSeqs))
+	}
+	testEquivalentRes(t, actualFunc, expectedFunc)
+}
+
+func TestTeeRereader(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqs(c, inSize)
+
+	f := func(n int, reses ...anydiff.Res) anydiff.Res {
+		return anydiff.Mul(reses[0], anydiff.Tanh(reses[1]))
+	}
+
+	testEquivalent(t, func() anyseq.Seq {
+		tees := lazyseq.TeeRereader(lazyseq.Lazify(inSeqs), 2)
+		return lazyseq.Unlazify(lazyseq.MapN(f, tees...))
+	}, func() anyseq.Seq {
+		return anyseq.MapN(f, inSeqs, inSeqs)
+	})
+}
+
+func TestTeeStreaming(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 3, 2)
+	outs := inSeqs.Output()
+
+	source := &upstreamSignalSeq{
+		Seq:      lazyseq.Lazify(inSeqs),
+		Received: make(chan *anyseq.Batch, len(outs)),
+	}
+	tees := lazyseq.Tee(source, 2)
+
+	upstreams := make([]chan *anyseq.Batch, len(tees))
+	var wg sync.WaitGroup
+	for i, tee := range tees {
+		upstreams[i] = make(chan *anyseq.Batch)
+		wg.Add(1)
+		go func(tee lazyseq.Seq, upstream <-chan *anyseq.Batch) {
+			defer wg.Done()
+			tee.Propagate(upstream, anydiff.NewGrad())
+		}(tee, upstreams[i])
+	}
+
+	for step := len(outs) - 1; step >= 0; step-- {
+		var expected []float64
+		for i, upstream := range upstreams {
+			vec := c.MakeVector(outs[step].Packed.Len())
+			anyvec.Rand(vec, anyvec.Normal, nil)
+			if i == 0 {
+				expected = append(expected, vec.Data().([]float64)...)
+			} else {
+				for j, x := range vec.Data().([]float64) {
+					expected[j] += x
+				}
+			}
+			upstream <- &anyseq.Batch{Packed: vec, Present: outs[step].Present}
+		}
+		select {
+		case batch := <-source.Received:
+			diff := batch.Packed.Copy()
+			diff.Sub(c.MakeVectorData(expected))
+			if anyvec.AbsMax(diff).(float64) > 1e-4 {
+				t.Errorf("timestep %d: expected %v but got %v", step, expected,
+					batch.Packed.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timestep %d: sum was not streamed", step)
+		}
+	}
+
+	for _, upstream := range upstreams {
+		close(upstream)
+	}
+	wg.Wait()
+}
+
+// upstreamSignalSeq sends a copy of every upstream batch
+// to Received as soon as it is read.
+type upstreamSignalSeq struct {
+	lazyseq.Seq
+	Received chan *anyseq.Batch
+}
+
+func (u *upstreamSignalSeq) Propagate(upstream <-chan *anyseq.Batch, grad lazyseq.Grad) {
+	inner := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range upstream {
+			u.Received <- &anyseq.Batch{Packed: batch.Packed.Copy(), Present: batch.Present}
+			inner <- batch
+		}
+		close(inner)
+	}()
+	u.Seq.Propagate(inner, grad)
+}
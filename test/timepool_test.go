@@ -0,0 +1,208 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestTimePool(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 9, 6)
+
+	ops := map[string]func(r lazyseq.Rereader, k int) lazyseq.Rereader{
+		"stride": lazyseq.Stride,
+		"avg":    lazyseq.AvgPoolTime,
+		"max":    lazyseq.MaxPoolTime,
+	}
+	for name, op := range ops {
+		for _, k := range []int{1, 2, 3, 4, 10} {
+			testEquivalent(t, func() anyseq.Seq {
+				return lazyseq.Unlazify(op(lazyseq.Lazify(inSeqs), k))
+			}, func() anyseq.Seq {
+				return &timePoolSeq{Seq: inSeqs, K: k, Mode: name}
+			})
+		}
+	}
+}
+
+func TestTimePoolReread(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 7, 0, 3, 9, 6)
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	ops := map[string]func(r lazyseq.Rereader, k int) lazyseq.Rereader{
+		"stride": lazyseq.Stride,
+		"avg":    lazyseq.AvgPoolTime,
+		"max":    lazyseq.MaxPoolTime,
+	}
+	for name, op := range ops {
+		testEquivalent(t, func() anyseq.Seq {
+			pooled := op(lazyseq.Lazify(inSeqs), 2)
+			return lazyseq.Unlazify(lazyrnn.FixedHSM(2, true, pooled, block))
+		}, func() anyseq.Seq {
+			return anyrnn.Map(&timePoolSeq{Seq: inSeqs, K: 2, Mode: name}, block)
+		})
+	}
+}
+
+func TestMaxPoolTimeTies(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+
+	// Every lane alternates between two vectors, so that
+	// each window has several maximum timesteps.
+	var vecs [][]anyvec.Vector
+	for _, length := range []int{5, 3, 4} {
+		pair := []anyvec.Vector{c.MakeVector(inSize), c.MakeVector(inSize)}
+		for _, v := range pair {
+			anyvec.Rand(v, anyvec.Normal, nil)
+		}
+		var seq []anyvec.Vector
+		for i := 0; i < length; i++ {
+			seq = append(seq, pair[i%2].Copy())
+		}
+		vecs = append(vecs, seq)
+	}
+	var resBatches []*anyseq.ResBatch
+	for _, batch := range anyseq.ConstSeqList(c, vecs).Output() {
+		resBatches = append(resBatches, &anyseq.ResBatch{
+			Packed:  anydiff.NewVar(batch.Packed),
+			Present: batch.Present,
+		})
+	}
+	inSeqs := anyseq.ResSeq(c, resBatches)
+
+	for _, k := range []int{2, 3, 4} {
+		testEquivalent(t, func() anyseq.Seq {
+			return lazyseq.Unlazify(lazyseq.MaxPoolTime(lazyseq.Lazify(inSeqs), k))
+		}, func() anyseq.Seq {
+			return &timePoolSeq{Seq: inSeqs, K: k, Mode: "max"}
+		})
+	}
+}
+
+// timePoolSeq is a reference implementation of Stride,
+// AvgPoolTime, and MaxPoolTime.
+type timePoolSeq struct {
+	anyseq.Seq
+	K    int
+	Mode string
+}
+
+func (t *timePoolSeq) Output() []*anyseq.Batch {
+	ins := t.Seq.Output()
+	var res []*anyseq.Batch
+	for start := 0; start < len(ins); start += t.K {
+		window := ins[start:essentials.MinInt(start+t.K, len(ins))]
+		batch := &anyseq.Batch{Present: window[0].Present}
+		var packed []float64
+		for _, rows := range t.windowRows(window) {
+			if rows == nil {
+				continue
+			}
+			out := append([]float64{}, rows[0]...)
+			for _, row := range rows[1:] {
+				for i, x := range row {
+					switch t.Mode {
+					case "avg":
+						out[i] += x
+					case "max":
+						if x > out[i] {
+							out[i] = x
+						}
+					}
+				}
+			}
+			if t.Mode == "avg" {
+				for i := range out {
+					out[i] /= float64(len(rows))
+				}
+			}
+			packed = append(packed, out...)
+		}
+		batch.Packed = t.Seq.Creator().MakeVectorData(packed)
+		res = append(res, batch)
+	}
+	return res
+}
+
+func (t *timePoolSeq) Propagate(u []*anyseq.Batch, g anydiff.Grad) {
+	ins := t.Seq.Output()
+	var downstream []*anyseq.Batch
+	for j, start := 0, 0; start < len(ins); j, start = j+1, start+t.K {
+		window := ins[start:essentials.MinInt(start+t.K, len(ins))]
+		rows := t.windowRows(window)
+		upRows := t.windowRows([]*anyseq.Batch{u[j]})
+		downRows := make([][][]float64, len(window))
+		for lane, laneRows := range rows {
+			if laneRows == nil {
+				continue
+			}
+			up := upRows[lane][0]
+			for step, row := range laneRows {
+				down := make([]float64, len(row))
+				for i := range down {
+					switch t.Mode {
+					case "stride":
+						if step == 0 {
+							down[i] = up[i]
+						}
+					case "avg":
+						down[i] = up[i] / float64(len(laneRows))
+					case "max":
+						isMax := true
+						for prev, other := range laneRows {
+							if (prev < step && other[i] >= row[i]) ||
+								(prev > step && other[i] > row[i]) {
+								isMax = false
+							}
+						}
+						if isMax {
+							down[i] = up[i]
+						}
+					}
+				}
+				downRows[step] = append(downRows[step], down)
+			}
+		}
+		for step, batch := range window {
+			var packed []float64
+			for _, row := range downRows[step] {
+				packed = append(packed, row...)
+			}
+			downstream = append(downstream, &anyseq.Batch{
+				Present: batch.Present,
+				Packed:  t.Seq.Creator().MakeVectorData(packed),
+			})
+		}
+	}
+	t.Seq.Propagate(downstream, g)
+}
+
+// windowRows gets the rows for each lane in a window.
+func (t *timePoolSeq) windowRows(window []*anyseq.Batch) [][][]float64 {
+	res := make([][][]float64, len(window[0].Present))
+	for _, batch := range window {
+		data := batch.Packed.Data().([]float64)
+		vecSize := len(data) / batch.NumPresent()
+		var idx int
+		for lane, pres := range batch.Present {
+			if pres {
+				res[lane] = append(res[lane], data[idx*vecSize:(idx+1)*vecSize])
+				idx++
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,169 @@
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestUnpack(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+	const inSize = 2
+
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 1, 0, 5),
+		testSeqsLen(c, inSize, 7, 1),
+		testSeqsLen(c, inSize, 0, 0),
+		testSeqsLen(c, inSize, 3, 4, 1, 3),
+	}
+
+	testEquivalent(t, func() anyseq.Seq {
+		packed := lazyseq.Lazify(packAnyseq(c, seqs))
+		pieces := lazyseq.Unpack(packed, []int{3, 2, 2, 4})
+		reordered := []lazyseq.Seq{pieces[3], pieces[1], pieces[2], pieces[0]}
+		return lazyseq.Unlazify(lazyseq.PackSeq(c, reordered))
+	}, func() anyseq.Seq {
+		reordered := []anyseq.Seq{seqs[3], seqs[1], seqs[2], seqs[0]}
+		return packAnyseq(c, reordered)
+	})
+}
+
+func TestUnpackRereader(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+
+	c := anyvec64.DefaultCreator{}
+	seqs := []anyseq.Seq{
+		testSeqsLen(c, inSize, 1, 0, 5),
+		testSeqsLen(c, inSize, 7, 1),
+		testSeqsLen(c, inSize, 3, 4, 1, 3),
+	}
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	testEquivalent(t, func() anyseq.Seq {
+		packed := lazyseq.Lazify(packAnyseq(c, seqs))
+		pieces := lazyseq.UnpackRereader(packed, []int{3, 2, 4})
+		reordered := []lazyseq.Rereader{pieces[2], pieces[0], pieces[1]}
+		return lazyseq.Unlazify(lazyrnn.FixedHSM(3, true,
+			lazyseq.PackRereader(c, reordered), block))
+	}, func() anyseq.Seq {
+		reordered := []anyseq.Seq{seqs[2], seqs[0], seqs[1]}
+		return anyrnn.Map(packAnyseq(c, reordered), block)
+	})
+}
+
+func TestUnpackTape(t *testing.T) {
+	c := anyvec64.DefaultCreator{}
+
+	tape, writer := lazyseq.ReferenceTape(c)
+	tracked := &drainTrackingTape{Tape: tape}
+	pieces := lazyseq.UnpackTape(tracked, []int{2, 1, 1})
+
+	inBatches := []*anyseq.Batch{
+		{Present: []bool{true, false, true, true}},
+		{Present: []bool{true, false, false, true}},
+		{Present: []bool{true, false, false, false}},
+	}
+	for _, b := range inBatches {
+		b.Packed = c.MakeVector(b.NumPresent() * 3)
+		anyvec.Rand(b.Packed, anyvec.Normal, nil)
+	}
+	for _, b := range inBatches {
+		writer <- b
+	}
+	close(writer)
+
+	var outBatches [3][]*anyseq.Batch
+	for _, b := range inBatches {
+		n := b.NumPresent()
+		outBatches[0] = append(outBatches[0], &anyseq.Batch{
+			Present: b.Present[:2],
+			Packed:  b.Packed.Slice(0, 3),
+		})
+		if b.Present[2] {
+			outBatches[1] = append(outBatches[1], &anyseq.Batch{
+				Present: b.Present[2:3],
+				Packed:  b.Packed.Slice(3, 6),
+			})
+		}
+		if b.Present[3] {
+			outBatches[2] = append(outBatches[2], &anyseq.Batch{
+				Present: b.Present[3:],
+				Packed:  b.Packed.Slice((n-1)*3, n*3),
+			})
+		}
+	}
+
+	for i, piece := range pieces {
+		ch := piece.ReadTape(0, -1)
+		for _, expected := range outBatches[i] {
+			mustRead(t, expected, ch)
+		}
+		mustRead(t, nil, ch)
+	}
+
+	// Sub-ranges may extend past the end of a piece, in
+	// which case the rest of the tape must still be read.
+	for i, piece := range pieces {
+		for start := 0; start <= len(inBatches); start++ {
+			for end := start; end <= len(inBatches); end++ {
+				ch := piece.ReadTape(start, end)
+				drained := tracked.LastDrained()
+				n := len(outBatches[i])
+				expBatches := outBatches[i][essentials.MinInt(start, n):essentials.MinInt(end, n)]
+				for _, expected := range expBatches {
+					mustRead(t, expected, ch)
+				}
+				mustRead(t, nil, ch)
+				select {
+				case <-drained:
+				case <-time.After(time.Second):
+					t.Fatalf("piece %d, range [%d, %d): tape was not drained", i,
+						start, end)
+				}
+			}
+		}
+	}
+}
+
+// drainTrackingTape records when each channel from
+// ReadTape has been read to completion.
+type drainTrackingTape struct {
+	lazyseq.Tape
+
+	lock    sync.Mutex
+	drained <-chan struct{}
+}
+
+func (d *drainTrackingTape) ReadTape(start, end int) <-chan *anyseq.Batch {
+	in := d.Tape.ReadTape(start, end)
+	out := make(chan *anyseq.Batch)
+	drained := make(chan struct{})
+	d.lock.Lock()
+	d.drained = drained
+	d.lock.Unlock()
+	go func() {
+		for batch := range in {
+			out <- batch
+		}
+		close(out)
+		close(drained)
+	}()
+	return out
+}
+
+// LastDrained returns a channel which is closed once the
+// last channel from ReadTape is drained.
+func (d *drainTrackingTape) LastDrained() <-chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.drained
+}
@@ -0,0 +1,177 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+)
+
+func TestUpsample(t *testing.T) {
+	const inSize = 3
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 4, 0, 3, 1)
+
+	for _, interp := range []bool{false, true} {
+		for _, k := range []int{1, 2, 3} {
+			testEquivalent(t, func() anyseq.Seq {
+				in := lazyseq.Lazify(inSeqs)
+				if interp {
+					return lazyseq.Unlazify(lazyseq.Interpolate(in, k))
+				}
+				return lazyseq.Unlazify(lazyseq.RepeatTime(in, k))
+			}, func() anyseq.Seq {
+				return &upsampleSeq{Seq: inSeqs, K: k, Interp: interp}
+			})
+		}
+	}
+}
+
+func TestUpsampleReread(t *testing.T) {
+	const inSize = 3
+	const outSize = 2
+	c := anyvec64.DefaultCreator{}
+	inSeqs := testSeqsLen(c, inSize, 2, 4, 0, 3, 1)
+	block := anyrnn.NewLSTM(c, inSize, outSize)
+
+	for _, interp := range []bool{false, true} {
+		testEquivalent(t, func() anyseq.Seq {
+			in := lazyseq.Lazify(inSeqs)
+			var upsampled lazyseq.Rereader
+			if interp {
+				upsampled = lazyseq.Interpolate(in, 3)
+			} else {
+				upsampled = lazyseq.RepeatTime(in, 3)
+			}
+			return lazyseq.Unlazify(lazyrnn.FixedHSM(4, true, upsampled, block))
+		}, func() anyseq.Seq {
+			return anyrnn.Map(&upsampleSeq{Seq: inSeqs, K: 3, Interp: interp}, block)
+		})
+	}
+}
+
+// upsampleSeq is a reference implementation of
+// RepeatTime and Interpolate.
+type upsampleSeq struct {
+	anyseq.Seq
+	K      int
+	Interp bool
+}
+
+func (u *upsampleSeq) Output() []*anyseq.Batch {
+	ins := u.Seq.Output()
+	var res []*anyseq.Batch
+	for t, batch := range ins {
+		rows := u.rows(batch)
+		nextRows := u.nextRows(ins, t)
+		for j := 0; j < u.K; j++ {
+			w := u.weight(j)
+			var packed []float64
+			for lane, row := range rows {
+				for i, x := range row {
+					packed = append(packed, (1-w)*x+w*nextRows[lane][i])
+				}
+			}
+			res = append(res, &anyseq.Batch{
+				Present: batch.Present,
+				Packed:  u.Seq.Creator().MakeVectorData(packed),
+			})
+		}
+	}
+	return res
+}
+
+func (u *upsampleSeq) Propagate(upstream []*anyseq.Batch, g anydiff.Grad) {
+	ins := u.Seq.Output()
+	downRows := make([][][]float64, len(ins))
+	for t, batch := range ins {
+		for _, row := range u.rows(batch) {
+			downRows[t] = append(downRows[t], make([]float64, len(row)))
+		}
+	}
+	for t, batch := range ins {
+		var lanes []int
+		for lane, pres := range batch.Present {
+			if pres {
+				lanes = append(lanes, lane)
+			}
+		}
+		for j := 0; j < u.K; j++ {
+			w := u.weight(j)
+			upRows := u.rows(upstream[t*u.K+j])
+			for rowIdx, lane := range lanes {
+				nextT, nextIdx := t, rowIdx
+				if t+1 < len(ins) && ins[t+1].Present[lane] {
+					nextT, nextIdx = t+1, 0
+					for _, p := range ins[t+1].Present[:lane] {
+						if p {
+							nextIdx++
+						}
+					}
+				}
+				for i, x := range upRows[rowIdx] {
+					downRows[t][rowIdx][i] += (1 - w) * x
+					downRows[nextT][nextIdx][i] += w * x
+				}
+			}
+		}
+	}
+	var downstream []*anyseq.Batch
+	for t, batch := range ins {
+		var packed []float64
+		for _, row := range downRows[t] {
+			packed = append(packed, row...)
+		}
+		downstream = append(downstream, &anyseq.Batch{
+			Present: batch.Present,
+			Packed:  u.Seq.Creator().MakeVectorData(packed),
+		})
+	}
+	u.Seq.Propagate(downstream, g)
+}
+
+func (u *upsampleSeq) weight(j int) float64 {
+	if !u.Interp {
+		return 0
+	}
+	return float64(j) / float64(u.K)
+}
+
+func (u *upsampleSeq) rows(batch *anyseq.Batch) [][]float64 {
+	data := batch.Packed.Data().([]float64)
+	vecSize := len(data) / batch.NumPresent()
+	var res [][]float64
+	for i := 0; i < batch.NumPresent(); i++ {
+		res = append(res, data[i*vecSize:(i+1)*vecSize])
+	}
+	return res
+}
+
+// nextRows gets the rows that each present lane at time
+// t interpolates towards.
+func (u *upsampleSeq) nextRows(ins []*anyseq.Batch, t int) [][]float64 {
+	rows := u.rows(ins[t])
+	if t+1 == len(ins) {
+		return rows
+	}
+	next := u.rows(ins[t+1])
+	var res [][]float64
+	var rowIdx, nextIdx int
+	for lane, pres := range ins[t].Present {
+		if !pres {
+			continue
+		}
+		if ins[t+1].Present[lane] {
+			res = append(res, next[nextIdx])
+			nextIdx++
+		} else {
+			res = append(res, rows[rowIdx])
+		}
+		rowIdx++
+	}
+	return res
+}
@@ -0,0 +1,397 @@
+package lazyseq
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+)
+
+// A timePooler combines windows of consecutive timesteps
+// into single timesteps.
+//
+// The first batch in a window determines the present map
+// of the pooled batch.
+// Later batches in a window may have fewer sequences,
+// since sequences may end in the middle of a window.
+type timePooler interface {
+	// pool combines the batches in a window.
+	pool(c anyvec.Creator, window []*anyseq.Batch) *anyseq.Batch
+
+	// unpool computes a gradient for every batch in the
+	// window given the gradient of the pooled batch.
+	//
+	// If needsInputs returns false, the window contains
+	// zero batches of the correct shapes rather than the
+	// actual inputs, and unpool may modify them.
+	unpool(c anyvec.Creator, window []*anyseq.Batch,
+		upstream *anyseq.Batch) []*anyseq.Batch
+
+	// needsInputs indicates whether unpool needs the
+	// actual inputs from the window.
+	needsInputs() bool
+}
+
+type timePoolRes struct {
+	In     Rereader
+	K      int
+	Pooler timePooler
+	Out    <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done       <-chan struct{}
+	Presents   [][]bool
+	PackedLens []int
+}
+
+// Stride creates a Rereader with every k-th timestep of
+// r, starting with the first timestep.
+//
+// A sequence of length n in r becomes a sequence of
+// length ceil(n/k) in the result.
+//
+// During back-propagation, the skipped timesteps receive
+// zero gradients.
+func Stride(r Rereader, k int) Rereader {
+	return newTimePoolRes(r, k, stridePooler{})
+}
+
+// AvgPoolTime creates a Rereader which averages windows
+// of k timesteps from r.
+//
+// A sequence of length n in r becomes a sequence of
+// length ceil(n/k) in the result.
+// If a sequence ends in the middle of a window, then the
+// last window for that sequence only averages over the
+// timesteps before the end.
+//
+// The vector size must be the same at every timestep.
+func AvgPoolTime(r Rereader, k int) Rereader {
+	return newTimePoolRes(r, k, avgPooler{})
+}
+
+// MaxPoolTime is like AvgPoolTime, but it computes the
+// component-wise maximum of each window rather than the
+// average.
+//
+// During back-propagation, the windows are reread from r
+// to find the maximum components.
+func MaxPoolTime(r Rereader, k int) Rereader {
+	return newTimePoolRes(r, k, maxPooler{})
+}
+
+func newTimePoolRes(r Rereader, k int, p timePooler) *timePoolRes {
+	if k < 1 {
+		panic("invalid window size")
+	}
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &timePoolRes{
+		In:     r,
+		K:      k,
+		Pooler: p,
+		Out:    outChan,
+		Done:   doneChan,
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (t *timePoolRes) Creator() anyvec.Creator {
+	return t.In.Creator()
+}
+
+func (t *timePoolRes) Forward() <-chan *anyseq.Batch {
+	return t.Out
+}
+
+func (t *timePoolRes) Vars() anydiff.VarSet {
+	return t.In.Vars()
+}
+
+func (t *timePoolRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range t.Forward() {
+	}
+
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		t.In.Propagate(downstream, grad)
+		wg.Done()
+	}()
+
+	c := t.Creator()
+	for i := t.length() - 1; i >= 0; i-- {
+		u, ok := <-upstream
+		if !ok {
+			panic("not enough upstream batches")
+		}
+		start := i * t.K
+		end := essentials.MinInt(start+t.K, len(t.Presents))
+		var window []*anyseq.Batch
+		if t.Pooler.needsInputs() {
+			for batch := range t.In.Reread(start, end) {
+				window = append(window, batch)
+			}
+		} else {
+			for j := start; j < end; j++ {
+				window = append(window, &anyseq.Batch{
+					Present: t.Presents[j],
+					Packed:  c.MakeVector(t.PackedLens[j]),
+				})
+			}
+		}
+		downs := t.Pooler.unpool(c, window, u)
+		for j := len(downs) - 1; j >= 0; j-- {
+			downstream <- downs[j]
+		}
+	}
+
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+func (t *timePoolRes) Reread(start, end int) <-chan *anyseq.Batch {
+	<-t.Done
+	if start < 0 || end < start || end > t.length() {
+		panic("slice bounds out of range")
+	}
+	srcEnd := essentials.MinInt(end*t.K, len(t.Presents))
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		t.poolWindows(t.In.Reread(start*t.K, srcEnd), res)
+		close(res)
+	}()
+	return res
+}
+
+func (t *timePoolRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	in := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range t.In.Forward() {
+			t.Presents = append(t.Presents, batch.Present)
+			t.PackedLens = append(t.PackedLens, batch.Packed.Len())
+			in <- batch
+		}
+		close(in)
+	}()
+	t.poolWindows(in, out)
+	close(done)
+	close(out)
+}
+
+// poolWindows pools consecutive windows of batches from
+// in, where the first batch from in starts a window.
+func (t *timePoolRes) poolWindows(in <-chan *anyseq.Batch, out chan<- *anyseq.Batch) {
+	c := t.Creator()
+	var window []*anyseq.Batch
+	for batch := range in {
+		window = append(window, batch)
+		if len(window) == t.K {
+			out <- t.Pooler.pool(c, window)
+			window = nil
+		}
+	}
+	if len(window) > 0 {
+		out <- t.Pooler.pool(c, window)
+	}
+}
+
+func (t *timePoolRes) length() int {
+	return (len(t.Presents) + t.K - 1) / t.K
+}
+
+type stridePooler struct{}
+
+func (s stridePooler) pool(c anyvec.Creator, window []*anyseq.Batch) *anyseq.Batch {
+	return window[0]
+}
+
+func (s stridePooler) unpool(c anyvec.Creator, window []*anyseq.Batch,
+	upstream *anyseq.Batch) []*anyseq.Batch {
+	window[0] = upstream
+	return window
+}
+
+func (s stridePooler) needsInputs() bool {
+	return false
+}
+
+type avgPooler struct{}
+
+func (a avgPooler) pool(c anyvec.Creator, window []*anyseq.Batch) *anyseq.Batch {
+	counts := windowCounts(window)
+	sums := make([]anyvec.Vector, len(counts))
+	for _, batch := range window {
+		for lane, row := range batchRows(window, batch) {
+			if row == nil {
+				continue
+			}
+			if sums[lane] == nil {
+				sums[lane] = row.Copy()
+			} else {
+				sums[lane].Add(row)
+			}
+		}
+	}
+	for lane, sum := range sums {
+		if sum != nil {
+			sum.Scale(c.MakeNumeric(1 / float64(counts[lane])))
+		}
+	}
+	return &anyseq.Batch{
+		Present: window[0].Present,
+		Packed:  concatSparse(c, sums),
+	}
+}
+
+func (a avgPooler) unpool(c anyvec.Creator, window []*anyseq.Batch,
+	upstream *anyseq.Batch) []*anyseq.Batch {
+	counts := windowCounts(window)
+	upRows := batchRows(window, upstream)
+	for _, batch := range window {
+		for lane, row := range batchRows(window, batch) {
+			if row != nil {
+				scaled := upRows[lane].Copy()
+				scaled.Scale(c.MakeNumeric(1 / float64(counts[lane])))
+				row.Set(scaled)
+			}
+		}
+	}
+	return window
+}
+
+func (a avgPooler) needsInputs() bool {
+	return false
+}
+
+type maxPooler struct{}
+
+func (m maxPooler) pool(c anyvec.Creator, window []*anyseq.Batch) *anyseq.Batch {
+	return &anyseq.Batch{
+		Present: window[0].Present,
+		Packed:  concatSparse(c, windowMaxes(c, window)),
+	}
+}
+
+func (m maxPooler) unpool(c anyvec.Creator, window []*anyseq.Batch,
+	upstream *anyseq.Batch) []*anyseq.Batch {
+	maxes := windowMaxes(c, window)
+	upRows := batchRows(window, upstream)
+
+	// Each component's gradient goes to the first timestep
+	// where it attains the maximum.
+	unclaimed := make([]anyvec.Vector, len(maxes))
+	for lane, laneMax := range maxes {
+		if laneMax != nil {
+			unclaimed[lane] = c.MakeVector(laneMax.Len())
+			unclaimed[lane].AddScalar(c.MakeNumeric(1))
+		}
+	}
+
+	res := make([]*anyseq.Batch, len(window))
+	for t, batch := range window {
+		rows := batchRows(window, batch)
+		for lane, row := range rows {
+			if row == nil {
+				continue
+			}
+			mask := row.Copy()
+			mask.Sub(maxes[lane])
+			anyvec.EqualTo(mask, c.MakeNumeric(0))
+			mask.Mul(unclaimed[lane])
+			unclaimed[lane].Sub(mask)
+			mask.Mul(upRows[lane])
+			rows[lane] = mask
+		}
+		res[t] = &anyseq.Batch{
+			Present: batch.Present,
+			Packed:  concatSparse(c, rows),
+		}
+	}
+	return res
+}
+
+func (m maxPooler) needsInputs() bool {
+	return true
+}
+
+// batchRows splits a batch from a window into one vector
+// per sequence, with nil entries for absent sequences.
+//
+// It panics if the batch does not have the same vector
+// size as the first batch in the window.
+func batchRows(window []*anyseq.Batch, batch *anyseq.Batch) []anyvec.Vector {
+	vecSize := window[0].Packed.Len() / window[0].NumPresent()
+	if batch.Packed.Len() != vecSize*batch.NumPresent() {
+		panic(fmt.Sprintf("vector size mismatch: expected %d per sequence",
+			vecSize))
+	}
+	res := make([]anyvec.Vector, len(batch.Present))
+	var idx int
+	for lane, pres := range batch.Present {
+		if pres {
+			res[lane] = batch.Packed.Slice(idx*vecSize, (idx+1)*vecSize)
+			idx++
+		}
+	}
+	return res
+}
+
+// windowCounts counts the number of timesteps for which
+// each sequence is present in a window.
+func windowCounts(window []*anyseq.Batch) []int {
+	res := make([]int, len(window[0].Present))
+	for _, batch := range window {
+		for lane, pres := range batch.Present {
+			if pres {
+				res[lane]++
+			}
+		}
+	}
+	return res
+}
+
+// windowMaxes computes the component-wise maximum of each
+// sequence's vectors in a window, with nil entries for
+// absent sequences.
+func windowMaxes(c anyvec.Creator, window []*anyseq.Batch) []anyvec.Vector {
+	maxes := make([]anyvec.Vector, len(window[0].Present))
+	for _, batch := range window {
+		for lane, row := range batchRows(window, batch) {
+			if row == nil {
+				continue
+			}
+			if maxes[lane] == nil {
+				maxes[lane] = row.Copy()
+			} else {
+				maxInPlace(c, maxes[lane], row)
+			}
+		}
+	}
+	return maxes
+}
+
+// maxInPlace sets every component of v1 to the maximum
+// of that component in v1 and v2.
+//
+// Components are selected rather than computed, so every
+// result is exactly equal to the corresponding input.
+func maxInPlace(c anyvec.Creator, v1, v2 anyvec.Vector) {
+	mask := v2.Copy()
+	mask.Sub(v1)
+	anyvec.GreaterThan(mask, c.MakeNumeric(0))
+	selected := v2.Copy()
+	selected.Mul(mask)
+	anyvec.Complement(mask)
+	v1.Mul(mask)
+	v1.Add(selected)
+}
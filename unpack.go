@@ -0,0 +1,227 @@
+package lazyseq
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+)
+
+type unpackState struct {
+	In          Seq
+	LanesPerSeq []int
+
+	// Fields become valid after Done is closed.
+	Done <-chan struct{}
+	Lens []int
+
+	Lock  sync.Mutex
+	Count int
+	Ups   [][]*anyseq.Batch
+}
+
+type unpackSeq struct {
+	*unpackState
+	Index int
+	Out   <-chan *anyseq.Batch
+}
+
+// Unpack is the inverse of PackSeq.
+// It splits the lanes of seq into separate Seqs, where
+// the i-th result gets the next lanesPerSeq[i] lanes.
+//
+// The sum of lanesPerSeq must equal the number of lanes
+// in seq.
+//
+// The results may be read at different rates.
+// Batches which one result has produced but another has
+// not are buffered.
+//
+// The upstream gradients of the results are joined and
+// then propagated through seq once every result has been
+// propagated through.
+// Thus, either all or none of the results should be
+// propagated through.
+func Unpack(seq Seq, lanesPerSeq []int) []Seq {
+	doneChan := make(chan struct{})
+	state := &unpackState{
+		In:          seq,
+		LanesPerSeq: lanesPerSeq,
+		Done:        doneChan,
+		Lens:        make([]int, len(lanesPerSeq)),
+		Ups:         make([][]*anyseq.Batch, len(lanesPerSeq)),
+	}
+
+	ins := make([]chan *anyseq.Batch, len(lanesPerSeq))
+	res := make([]Seq, len(lanesPerSeq))
+	for i := range ins {
+		ins[i] = make(chan *anyseq.Batch, 1)
+		res[i] = &unpackSeq{
+			unpackState: state,
+			Index:       i,
+			Out:         bufferBatches(ins[i]),
+		}
+	}
+
+	go state.forward(ins, doneChan)
+
+	return res
+}
+
+func (u *unpackSeq) Creator() anyvec.Creator {
+	return u.In.Creator()
+}
+
+func (u *unpackSeq) Forward() <-chan *anyseq.Batch {
+	return u.Out
+}
+
+func (u *unpackSeq) Vars() anydiff.VarSet {
+	return u.In.Vars()
+}
+
+func (u *unpackSeq) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range u.Forward() {
+	}
+
+	batches := make([]*anyseq.Batch, u.Lens[u.Index])
+	for t := len(batches) - 1; t >= 0; t-- {
+		batch, ok := <-upstream
+		if !ok {
+			panic("not enough upstream batches")
+		}
+		batches[t] = batch
+	}
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	u.Lock.Lock()
+	u.Ups[u.Index] = batches
+	u.Count++
+	if u.Count < len(u.LanesPerSeq) {
+		u.Lock.Unlock()
+		return
+	}
+	ups := u.Ups
+	u.Ups = make([][]*anyseq.Batch, len(u.LanesPerSeq))
+	u.Count = 0
+	u.Lock.Unlock()
+
+	var numSteps int
+	for _, l := range u.Lens {
+		if l > numSteps {
+			numSteps = l
+		}
+	}
+
+	c := u.Creator()
+	downstream := make(chan *anyseq.Batch, 1)
+	go func() {
+		for t := numSteps - 1; t >= 0; t-- {
+			var batches []*anyseq.Batch
+			for i, pieceUps := range ups {
+				if t < len(pieceUps) {
+					batches = append(batches, pieceUps[t])
+				} else {
+					batches = append(batches, fillerBatch(c, u.LanesPerSeq[i]))
+				}
+			}
+			downstream <- joinBatches(c, batches)
+		}
+		close(downstream)
+	}()
+	u.In.Propagate(downstream, grad)
+}
+
+func (u *unpackState) forward(outs []chan *anyseq.Batch, done chan<- struct{}) {
+	for batch := range u.In.Forward() {
+		u.checkLanes(batch)
+		for i, sub := range splitLanes(batch, u.LanesPerSeq) {
+			if sub != nil {
+				u.Lens[i]++
+				outs[i] <- sub
+			}
+		}
+	}
+	close(done)
+	for _, ch := range outs {
+		close(ch)
+	}
+}
+
+func (u *unpackState) checkLanes(batch *anyseq.Batch) {
+	var total int
+	for _, n := range u.LanesPerSeq {
+		total += n
+	}
+	if total != len(batch.Present) {
+		panic("lane count mismatch")
+	}
+}
+
+type unpackRereader struct {
+	*unpackSeq
+	Rereader Rereader
+}
+
+// UnpackRereader is like Unpack, but for Rereaders.
+func UnpackRereader(r Rereader, lanesPerSeq []int) []Rereader {
+	res := make([]Rereader, len(lanesPerSeq))
+	for i, seq := range Unpack(r, lanesPerSeq) {
+		res[i] = &unpackRereader{unpackSeq: seq.(*unpackSeq), Rereader: r}
+	}
+	return res
+}
+
+func (u *unpackRereader) Reread(start, end int) <-chan *anyseq.Batch {
+	<-u.Done
+	if start < 0 || end < start || end > u.Lens[u.Index] {
+		panic("slice bounds out of range")
+	}
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range u.Rereader.Reread(start, end) {
+			res <- splitLanes(batch, u.LanesPerSeq)[u.Index]
+		}
+		close(res)
+	}()
+	return res
+}
+
+type unpackedTape struct {
+	In          Tape
+	LanesPerSeq []int
+	Index       int
+}
+
+// UnpackTape is the inverse of PackTape.
+// It splits the lanes of t into separate Tapes, where the
+// i-th result gets the next lanesPerSeq[i] lanes.
+func UnpackTape(t Tape, lanesPerSeq []int) []Tape {
+	res := make([]Tape, len(lanesPerSeq))
+	for i := range res {
+		res[i] = &unpackedTape{In: t, LanesPerSeq: lanesPerSeq, Index: i}
+	}
+	return res
+}
+
+func (u *unpackedTape) Creator() anyvec.Creator {
+	return u.In.Creator()
+}
+
+func (u *unpackedTape) ReadTape(start, end int) <-chan *anyseq.Batch {
+	res := make(chan *anyseq.Batch, 1)
+	go func() {
+		defer close(res)
+		// Keep draining the input after this piece ends,
+		// since the tape may block until it is read.
+		for in := range u.In.ReadTape(start, end) {
+			if sub := splitLanes(in, u.LanesPerSeq)[u.Index]; sub != nil {
+				res <- sub
+			}
+		}
+	}()
+	return res
+}
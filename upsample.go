@@ -0,0 +1,244 @@
+package lazyseq
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+)
+
+type upsampleRes struct {
+	In     Rereader
+	K      int
+	Interp bool
+	Out    <-chan *anyseq.Batch
+
+	// Fields become valid after Done is closed.
+	Done     <-chan struct{}
+	Presents [][]bool
+}
+
+// RepeatTime creates a Rereader which repeats every
+// timestep of r k times in a row.
+//
+// A sequence of length n in r becomes a sequence of
+// length n*k in the result.
+//
+// During back-propagation, the gradients of the k copies
+// of a timestep are summed.
+func RepeatTime(r Rereader, k int) Rereader {
+	return newUpsampleRes(r, k, false)
+}
+
+// Interpolate is like RepeatTime, but it linearly
+// interpolates between consecutive timesteps of r rather
+// than repeating them.
+//
+// Specifically, output timestep i*k+j is a weighted sum
+// of timesteps i and i+1 of r, where timestep i+1 has a
+// weight of j/k.
+// At the end of a sequence, there is no next timestep to
+// interpolate towards, so the last timestep is repeated.
+//
+// The vector size must be the same at every timestep.
+func Interpolate(r Rereader, k int) Rereader {
+	return newUpsampleRes(r, k, true)
+}
+
+func newUpsampleRes(r Rereader, k int, interp bool) *upsampleRes {
+	if k < 1 {
+		panic("invalid repeat count")
+	}
+	outChan := make(chan *anyseq.Batch, 1)
+	doneChan := make(chan struct{})
+	res := &upsampleRes{
+		In:     r,
+		K:      k,
+		Interp: interp,
+		Out:    outChan,
+		Done:   doneChan,
+	}
+	go res.forward(outChan, doneChan)
+	return res
+}
+
+func (u *upsampleRes) Creator() anyvec.Creator {
+	return u.In.Creator()
+}
+
+func (u *upsampleRes) Forward() <-chan *anyseq.Batch {
+	return u.Out
+}
+
+func (u *upsampleRes) Vars() anydiff.VarSet {
+	return u.In.Vars()
+}
+
+func (u *upsampleRes) Propagate(upstream <-chan *anyseq.Batch, grad Grad) {
+	for _ = range u.Forward() {
+	}
+
+	downstream := make(chan *anyseq.Batch, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		u.In.Propagate(downstream, grad)
+		wg.Done()
+	}()
+
+	c := u.Creator()
+
+	// The gradient for the timestep after the current
+	// one, which needs contributions from the current
+	// timestep's window before it is complete.
+	var pending *anyseq.Batch
+
+	for t := len(u.Presents) - 1; t >= 0; t-- {
+		present := u.Presents[t]
+		var current, next anyvec.Vector
+		for j := u.K - 1; j >= 0; j-- {
+			upBatch, ok := <-upstream
+			if !ok {
+				panic("not enough upstream batches")
+			}
+			if current == nil {
+				current = c.MakeVector(upBatch.Packed.Len())
+				next = c.MakeVector(upBatch.Packed.Len())
+			}
+			nextWeight := u.nextWeight(j)
+			scaled := upBatch.Packed.Copy()
+			scaled.Scale(c.MakeNumeric(1 - nextWeight))
+			current.Add(scaled)
+			if nextWeight != 0 {
+				scaled = upBatch.Packed.Copy()
+				scaled.Scale(c.MakeNumeric(nextWeight))
+				next.Add(scaled)
+			}
+		}
+
+		nextBatch := &anyseq.Batch{Present: present, Packed: next}
+		if pending != nil {
+			toNext := nextBatch.Reduce(pending.Present)
+			pending.Packed.Add(toNext.Packed)
+			downstream <- pending
+
+			// Sequences which end at this timestep use
+			// it in place of the next timestep.
+			next.Sub(toNext.Expand(present).Packed)
+		}
+		current.Add(next)
+		pending = &anyseq.Batch{Present: present, Packed: current}
+	}
+	if pending != nil {
+		downstream <- pending
+	}
+
+	if _, ok := <-upstream; ok {
+		panic("too many upstream batches")
+	}
+
+	close(downstream)
+	wg.Wait()
+}
+
+func (u *upsampleRes) Reread(start, end int) <-chan *anyseq.Batch {
+	<-u.Done
+	if start < 0 || end < start || end > len(u.Presents)*u.K {
+		panic("slice bounds out of range")
+	}
+	res := make(chan *anyseq.Batch, 1)
+	if start == end {
+		close(res)
+		return res
+	}
+	srcStart := start / u.K
+	srcEnd := (end-1)/u.K + 1
+	if u.Interp {
+		srcEnd = essentials.MinInt(srcEnd+1, len(u.Presents))
+	}
+	go func() {
+		u.upsample(u.In.Reread(srcStart, srcEnd), srcStart, start, end, res)
+		close(res)
+	}()
+	return res
+}
+
+func (u *upsampleRes) forward(out chan<- *anyseq.Batch, done chan<- struct{}) {
+	in := make(chan *anyseq.Batch, 1)
+	go func() {
+		for batch := range u.In.Forward() {
+			u.Presents = append(u.Presents, batch.Present)
+			in <- batch
+		}
+		close(in)
+	}()
+	u.upsample(in, 0, 0, -1, out)
+	close(done)
+	close(out)
+}
+
+// upsample produces the output timesteps in the range
+// [start, end) from a channel of input timesteps which
+// begins at timestep srcStart.
+//
+// If end is -1, all of the output timesteps are produced.
+func (u *upsampleRes) upsample(in <-chan *anyseq.Batch, srcStart, start, end int,
+	out chan<- *anyseq.Batch) {
+	var prev *anyseq.Batch
+	srcIdx := srcStart
+	for batch := range in {
+		if prev != nil {
+			u.upsampleStep(prev, batch, srcIdx-1, start, end, out)
+		}
+		prev = batch
+		srcIdx++
+	}
+	if prev != nil {
+		u.upsampleStep(prev, nil, srcIdx-1, start, end, out)
+	}
+}
+
+func (u *upsampleRes) upsampleStep(batch, next *anyseq.Batch, srcIdx, start, end int,
+	out chan<- *anyseq.Batch) {
+	var nextVec anyvec.Vector
+	if u.Interp {
+		// Sequences that end at this timestep interpolate
+		// towards themselves.
+		nextVec = batch.Packed.Copy()
+		if next != nil {
+			diff := next.Packed.Copy()
+			diff.Sub(batch.Reduce(next.Present).Packed)
+			nextVec.Add((&anyseq.Batch{Present: next.Present, Packed: diff}).
+				Expand(batch.Present).Packed)
+		}
+	}
+	c := u.Creator()
+	for j := 0; j < u.K; j++ {
+		t := srcIdx*u.K + j
+		if t < start || (t >= end && end != -1) {
+			continue
+		}
+		nextWeight := u.nextWeight(j)
+		if nextWeight == 0 {
+			out <- batch
+			continue
+		}
+		packed := batch.Packed.Copy()
+		packed.Scale(c.MakeNumeric(1 - nextWeight))
+		scaledNext := nextVec.Copy()
+		scaledNext.Scale(c.MakeNumeric(nextWeight))
+		packed.Add(scaledNext)
+		out <- &anyseq.Batch{Present: batch.Present, Packed: packed}
+	}
+}
+
+// nextWeight computes the weight given to the next input
+// timestep for the j-th copy of an input timestep.
+func (u *upsampleRes) nextWeight(j int) float64 {
+	if !u.Interp {
+		return 0
+	}
+	return float64(j) / float64(u.K)
+}